@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// AdminServer serves the operations endpoints, which are only reachable with the admin token
+type AdminServer struct {
+	Config  *Config
+	Lockout *Lockout
+	Quota   *Quota
+}
+
+// UnlockRequest names the remote IP and/or username to unlock
+type UnlockRequest struct {
+	Ip       string `json:"ip,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type UnlockResponse struct {
+	Unlocked []LockoutEntry `json:"unlocked"`
+}
+
+// LogSettings are the current log level and format, either can be left out when changing them
+type LogSettings struct {
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/lockouts", a.requireToken(http.HandlerFunc(a.handleLockouts)))
+	mux.Handle("/admin/unlock", a.requireToken(http.HandlerFunc(a.handleUnlock)))
+	mux.Handle("/admin/quota", a.requireToken(http.HandlerFunc(a.handleQuota)))
+	mux.Handle("/admin/log", a.requireToken(http.HandlerFunc(a.handleLog)))
+	return mux
+}
+
+// requireToken rejects requests without the admin bearer token
+func (a *AdminServer) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.Config.Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.Admin.Token)) != 1 {
+			log.Warn().Str("event", "admin_unauthorized").Str("remote_addr", r.RemoteAddr).Str("path", r.URL.Path).Msg("Rejected admin request without a valid token")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminServer) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, a.Lockout.List())
+}
+
+func (a *AdminServer) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Ip == "" && request.Username == "") {
+		http.Error(w, "an ip or username is required", http.StatusBadRequest)
+		return
+	}
+
+	response := UnlockResponse{Unlocked: []LockoutEntry{}}
+	if request.Ip != "" && a.Lockout.Unlock(lockoutKindIp, request.Ip) {
+		response.Unlocked = append(response.Unlocked, LockoutEntry{Kind: lockoutKindIp, Value: request.Ip})
+	}
+	if request.Username != "" && a.Lockout.Unlock(lockoutKindUsername, request.Username) {
+		response.Unlocked = append(response.Unlocked, LockoutEntry{Kind: lockoutKindUsername, Value: request.Username})
+	}
+
+	log.Warn().Str("event", "auth_unlock").Str("remote_addr", r.RemoteAddr).Str("ip", request.Ip).Str("username", redactUsername(request.Username)).Int("unlocked", len(response.Unlocked)).Msg("Lockout cleared by an admin")
+	writeJson(w, http.StatusOK, response)
+}
+
+func (a *AdminServer) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, a.Quota.State())
+}
+
+func (a *AdminServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request LogSettings
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Level == "" && request.Format == "") {
+			http.Error(w, "a level or format is required", http.StatusBadRequest)
+			return
+		}
+
+		level := zerolog.GlobalLevel()
+		if request.Level != "" {
+			var err error
+			if level, err = parseLogLevel(strings.ToLower(request.Level)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		format := strings.ToLower(request.Format)
+		if format != "" && !isValidLogFormat(format) {
+			http.Error(w, "log format must be json or console", http.StatusBadRequest)
+			return
+		}
+
+		zerolog.SetGlobalLevel(level)
+		if format != "" {
+			logOutput.set(format)
+		}
+		log.WithLevel(zerolog.NoLevel).Str("event", "log_settings_changed").Str("remote_addr", r.RemoteAddr).Str("level", level.String()).Str("format", logOutput.Format()).Msg("Log settings changed by an admin")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(w, http.StatusOK, LogSettings{Level: zerolog.GlobalLevel().String(), Format: logOutput.Format()})
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Msgf("Error writing response: %s", err)
+	}
+}
+
+func startAdminServer(admin *AdminServer) {
+	server := &http.Server{
+		Addr:              admin.Config.Admin.Addr,
+		Handler:           admin.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Info().Msgf("Admin server listening on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal().Err(err).Msg("Admin server failed")
+	}
+}
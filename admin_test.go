@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "test-admin-token-0123456789abcdef"
+
+func newTestAdminServer() (*AdminServer, *Lockout) {
+	config := &Config{}
+	config.Admin.Token = testAdminToken
+	lockout, _ := newTestLockout()
+	return &AdminServer{Config: config, Lockout: lockout}, lockout
+}
+
+func TestAdminServer_RequiresToken(t *testing.T) {
+	admin, _ := newTestAdminServer()
+
+	for _, token := range []string{"", "Bearer wrong-token", testAdminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/lockouts", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		admin.Handler().ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAdminServer_Lockouts(t *testing.T) {
+	admin, lockout := newTestAdminServer()
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Failure("10.0.0.1", "grafana")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/lockouts", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var entries []LockoutEntry
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&entries))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "grafana", entries[0].Value)
+}
+
+func TestAdminServer_Unlock(t *testing.T) {
+	admin, lockout := newTestAdminServer()
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Failure("10.0.0.1", "grafana")
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/unlock", strings.NewReader(`{"username":"grafana","ip":"10.0.0.1"}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response UnlockResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, []LockoutEntry{{Kind: "username", Value: "grafana"}}, response.Unlocked)
+	assert.Empty(t, lockout.List())
+
+	// A body without an ip or username is rejected
+	req = httptest.NewRequest(http.MethodPost, "/admin/unlock", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w = httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/unlock", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w = httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminServer_Quota(t *testing.T) {
+	admin, _ := newTestAdminServer()
+	admin.Quota, _ = newTestQuota(t)
+	admin.Quota.Add(testServiceApiKey, 0, 2)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/quota", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var state QuotaState
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&state))
+	assert.Equal(t, "2024-01-01", state.Day)
+	assert.Equal(t, map[string]int{apiKeyName(testServiceApiKey): 2}, state.Counts)
+}
+
+func TestAdminServer_Log(t *testing.T) {
+	level, format := zerolog.GlobalLevel(), logOutput.Format()
+	t.Cleanup(func() {
+		zerolog.SetGlobalLevel(level)
+		logOutput.set(format)
+	})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	logOutput.set(logFormatJson)
+
+	admin, _ := newTestAdminServer()
+	request := func(method string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/log", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		w := httptest.NewRecorder()
+		admin.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var settings LogSettings
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&settings))
+	assert.Equal(t, LogSettings{Level: "info", Format: "json"}, settings)
+
+	// Only the level changes when the format is left out
+	w = request(http.MethodPut, `{"level":"DEBUG"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&settings))
+	assert.Equal(t, LogSettings{Level: "debug", Format: "json"}, settings)
+	assert.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+
+	w = request(http.MethodPut, `{"format":"console"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, logFormatConsole, logOutput.Format())
+	assert.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+
+	// Invalid settings change nothing
+	w = request(http.MethodPut, `{"level":"verbose","format":"json"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPut, `{"level":"info","format":"text"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request(http.MethodPut, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+	assert.Equal(t, logFormatConsole, logOutput.Format())
+
+	w = request(http.MethodDelete, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -2,12 +2,27 @@ package main
 
 import (
 	"errors"
-	"regexp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
+	// Log settings, the level can be changed at runtime with SIGUSR1 or the admin server
+	Log struct {
+		Level  zerolog.Level
+		Format string
+
+		// How email addresses and subjects are logged: none, mask or hash
+		Redaction    string
+		RedactionKey string
+	}
+
 	// Notify settings
 	Notify struct {
 		ApiKey     string
@@ -15,6 +30,25 @@ type Config struct {
 		TemplateId string
 	}
 
+	// HTTP client settings for requests to Notify
+	NotifyHttp struct {
+		// Overall request timeout and the time allowed to connect and complete the TLS handshake
+		Timeout             time.Duration
+		ConnectTimeout      time.Duration
+		TlsHandshakeTimeout time.Duration
+
+		// Connection pool sizes
+		MaxIdleConns        int
+		MaxIdleConnsPerHost int
+		MaxConnsPerHost     int
+		IdleConnTimeout     time.Duration
+
+		// Optional CA bundle and client certificate for egress through an inspecting proxy
+		CaFile         string
+		ClientCertFile string
+		ClientKeyFile  string
+	}
+
 	// SMTP settings
 	Smtp struct {
 		// Hostname to listen on
@@ -30,6 +64,147 @@ type Config struct {
 		TlsCertFile string
 		TlsKeyFile  string
 	}
+
+	// Template routing settings
+	Routing struct {
+		// YAML file with the rules that pick a template for each message
+		RulesFile string
+		Rules     []TemplateRule
+	}
+
+	// Message settings
+	Message struct {
+		// Convert the HTML part to markdown even when there is a text part
+		PreferHtml bool
+
+		// How X-Notify-Personalisation-* header names become personalisation keys
+		PersonalisationKeyTransform string
+	}
+
+	// Authentication settings
+	Auth struct {
+		// YAML file listing the SMTP users and the Notify service each one sends as
+		UsersFile string
+		Users     []*Tenant
+
+		// Accept passwords that aren't hashed, for development only
+		AllowPlaintextPasswords bool
+
+		// SASL mechanisms advertised to clients
+		Mechanisms []string
+
+		// Envelope senders the single configured user can use, and whether the From:
+		// header is checked too. Users in the users file set their own.
+		AllowedSenders  []string
+		CheckHeaderFrom bool
+	}
+
+	// Client networks allowed to connect
+	Network struct {
+		AllowCidrs []netip.Prefix
+		DenyCidrs  []netip.Prefix
+	}
+
+	// Recipients any user can send to
+	Recipients RecipientPolicy
+
+	// Rate limits per minute, per user, per remote IP and across the server. A limit
+	// of 0 disables it.
+	RateLimit struct {
+		Messages   RateLimits
+		Recipients RateLimits
+	}
+
+	// Daily sending quota of each Notify API key, counted per UTC day
+	Quota struct {
+		// Notifications each API key can send a day, 0 counts without a limit
+		DailyLimit int
+
+		// Percentages of the daily limit that log a warning
+		WarnThresholds []int
+
+		// File the counts are saved to so they survive restarts
+		StateFile string
+	}
+
+	// Brute-force protection, counted per remote IP and per username. A max
+	// failures of 0 disables the lockout.
+	Lockout struct {
+		IpMaxFailures int
+		IpWindow      time.Duration
+		IpDuration    time.Duration
+
+		UsernameMaxFailures int
+		UsernameWindow      time.Duration
+		UsernameDuration    time.Duration
+	}
+
+	// Admin HTTP server
+	Admin struct {
+		// Address to listen on, the server is disabled when empty
+		Addr string
+
+		// Bearer token required by the /admin endpoints
+		Token string
+	}
+
+	// Prometheus metrics server
+	Metrics struct {
+		// Address to serve /metrics on, the server is disabled when empty
+		Addr string
+	}
+
+	// Health check server
+	Health struct {
+		// Address to serve /healthz and /readyz on, the server is disabled when empty.
+		// It can be the same as the metrics address.
+		Addr string
+	}
+
+	// OpenTelemetry tracing settings
+	Tracing struct {
+		// Where spans are exported: none, otlp or file
+		Exporter string
+
+		// OTLP/HTTP endpoint such as http://localhost:4318, the OTEL_EXPORTER_OTLP_*
+		// variables are used when empty
+		Endpoint string
+
+		// File the file exporter appends spans to
+		File string
+
+		// Fraction of sessions that are traced, from 0 to 1
+		SampleRatio float64
+	}
+
+	// Spool settings
+	Spool struct {
+		// Queue messages on disk and deliver them in the background
+		Enabled bool
+		Dir     string
+
+		// How often the delivery worker drains the spool
+		PollInterval time.Duration
+
+		// How long to keep retrying a message before giving up
+		MaxAge time.Duration
+	}
+
+	// Retry settings for Notify API requests
+	Retry struct {
+		MaxAttempts    int
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+	}
+
+	// Delivery settings
+	Delivery struct {
+		// Number of recipients of a single email sent to Notify in parallel
+		Concurrency int
+
+		// Number of requests to Notify in flight across all sessions
+		MaxConcurrency int
+	}
 }
 
 func initConfig() (*Config, error) {
@@ -39,10 +214,23 @@ func initConfig() (*Config, error) {
 	var err error
 
 	// Set default values
-	viper.SetDefault("LogLevel", "info")
+	viper.SetDefault("Log_Level", "info")
+	viper.SetDefault("Log_Format", "json")
+	viper.SetDefault("Log_Redaction", "none")
+	viper.SetDefault("Log_Redaction_Key", "")
 	viper.SetDefault("Notify_ApiKey", "")
 	viper.SetDefault("Notify_Hostname", "https://api.notification.canada.ca")
 	viper.SetDefault("Notify_Template_Id", "")
+	viper.SetDefault("Notify_Http_Timeout", "10s")
+	viper.SetDefault("Notify_Http_Connect_Timeout", "5s")
+	viper.SetDefault("Notify_Http_Tls_Handshake_Timeout", "5s")
+	viper.SetDefault("Notify_Http_Max_Idle_Conns", 100)
+	viper.SetDefault("Notify_Http_Max_Idle_Conns_Per_Host", 20)
+	viper.SetDefault("Notify_Http_Max_Conns_Per_Host", 0)
+	viper.SetDefault("Notify_Http_Idle_Conn_Timeout", "90s")
+	viper.SetDefault("Notify_Http_Ca_File", "")
+	viper.SetDefault("Notify_Http_Client_Cert_File", "")
+	viper.SetDefault("Notify_Http_Client_Key_File", "")
 	viper.SetDefault("Smtp_Hostname", "localhost")
 	viper.SetDefault("Smtp_Port", 1025)
 	viper.SetDefault("Smtp_Username", "")
@@ -50,10 +238,67 @@ func initConfig() (*Config, error) {
 	viper.SetDefault("Smtp_Use_tls", false)
 	viper.SetDefault("Smtp_tls_cert_file", "")
 	viper.SetDefault("Smtp_tls_key_file", "")
+	viper.SetDefault("Auth_Users_File", "")
+	viper.SetDefault("Auth_Allow_Plaintext_Passwords", false)
+	viper.SetDefault("Auth_Mechanisms", "PLAIN,LOGIN")
+	viper.SetDefault("Auth_Allowed_Senders", "")
+	viper.SetDefault("Auth_Check_Header_From", false)
+	viper.SetDefault("Network_Allow_Cidrs", "")
+	viper.SetDefault("Network_Deny_Cidrs", "")
+	viper.SetDefault("Recipients_Allow", "")
+	viper.SetDefault("Recipients_Deny", "")
+	viper.SetDefault("Rate_Limit_User_Messages", 0)
+	viper.SetDefault("Rate_Limit_User_Recipients", 0)
+	viper.SetDefault("Rate_Limit_Ip_Messages", 0)
+	viper.SetDefault("Rate_Limit_Ip_Recipients", 0)
+	viper.SetDefault("Rate_Limit_Global_Messages", 0)
+	viper.SetDefault("Rate_Limit_Global_Recipients", 0)
+	viper.SetDefault("Quota_Daily_Limit", 0)
+	viper.SetDefault("Quota_Warn_Thresholds", "80,90")
+	viper.SetDefault("Quota_State_File", "./quota.json")
+	viper.SetDefault("Lockout_Ip_Max_Failures", 20)
+	viper.SetDefault("Lockout_Ip_Window", "15m")
+	viper.SetDefault("Lockout_Ip_Duration", "15m")
+	viper.SetDefault("Lockout_Username_Max_Failures", 5)
+	viper.SetDefault("Lockout_Username_Window", "15m")
+	viper.SetDefault("Lockout_Username_Duration", "15m")
+	viper.SetDefault("Admin_Addr", "")
+	viper.SetDefault("Admin_Token", "")
+	viper.SetDefault("Metrics_Addr", "")
+	viper.SetDefault("Health_Addr", "")
+	viper.SetDefault("Tracing_Exporter", "none")
+	viper.SetDefault("Tracing_Endpoint", "")
+	viper.SetDefault("Tracing_File", "./traces.json")
+	viper.SetDefault("Tracing_Sample_Ratio", 1.0)
+	viper.SetDefault("Routing_Rules_File", "")
+	viper.SetDefault("Message_Prefer_Html", false)
+	viper.SetDefault("Message_Personalisation_Key_Transform", "snake")
+	viper.SetDefault("Spool_Enabled", false)
+	viper.SetDefault("Spool_Dir", "./spool")
+	viper.SetDefault("Spool_Poll_Interval", "5s")
+	viper.SetDefault("Spool_Max_Age", "72h")
+	viper.SetDefault("Retry_Max_Attempts", 3)
+	viper.SetDefault("Retry_Initial_Backoff", "500ms")
+	viper.SetDefault("Retry_Max_Backoff", "5s")
+	viper.SetDefault("Delivery_Concurrency", 4)
+	viper.SetDefault("Delivery_Max_Concurrency", 20)
 
+	configuration.Log.Format = strings.ToLower(viper.GetString("Log_Format"))
+	configuration.Log.Redaction = strings.ToLower(viper.GetString("Log_Redaction"))
+	configuration.Log.RedactionKey = viper.GetString("Log_Redaction_Key")
 	configuration.Notify.ApiKey = viper.GetString("Notify_ApiKey")
 	configuration.Notify.Hostname = viper.GetString("Notify_Hostname")
 	configuration.Notify.TemplateId = viper.GetString("Notify_Template_Id")
+	configuration.NotifyHttp.Timeout = viper.GetDuration("Notify_Http_Timeout")
+	configuration.NotifyHttp.ConnectTimeout = viper.GetDuration("Notify_Http_Connect_Timeout")
+	configuration.NotifyHttp.TlsHandshakeTimeout = viper.GetDuration("Notify_Http_Tls_Handshake_Timeout")
+	configuration.NotifyHttp.MaxIdleConns = viper.GetInt("Notify_Http_Max_Idle_Conns")
+	configuration.NotifyHttp.MaxIdleConnsPerHost = viper.GetInt("Notify_Http_Max_Idle_Conns_Per_Host")
+	configuration.NotifyHttp.MaxConnsPerHost = viper.GetInt("Notify_Http_Max_Conns_Per_Host")
+	configuration.NotifyHttp.IdleConnTimeout = viper.GetDuration("Notify_Http_Idle_Conn_Timeout")
+	configuration.NotifyHttp.CaFile = viper.GetString("Notify_Http_Ca_File")
+	configuration.NotifyHttp.ClientCertFile = viper.GetString("Notify_Http_Client_Cert_File")
+	configuration.NotifyHttp.ClientKeyFile = viper.GetString("Notify_Http_Client_Key_File")
 	configuration.Smtp.Hostname = viper.GetString("Smtp_Hostname")
 	configuration.Smtp.Port = viper.GetInt("Smtp_Port")
 	configuration.Smtp.Username = viper.GetString("Smtp_Username")
@@ -61,43 +306,298 @@ func initConfig() (*Config, error) {
 	configuration.Smtp.UseTLS = viper.GetBool("Smtp_Use_TLS")
 	configuration.Smtp.TlsCertFile = viper.GetString("Smtp_tls_cert_file")
 	configuration.Smtp.TlsKeyFile = viper.GetString("Smtp_tls_key_file")
+	configuration.Auth.UsersFile = viper.GetString("Auth_Users_File")
+	configuration.Auth.AllowPlaintextPasswords = viper.GetBool("Auth_Allow_Plaintext_Passwords")
+	configuration.Auth.Mechanisms = parseMechanisms(viper.GetString("Auth_Mechanisms"))
+	configuration.Auth.AllowedSenders = parseList(viper.GetString("Auth_Allowed_Senders"))
+	configuration.Auth.CheckHeaderFrom = viper.GetBool("Auth_Check_Header_From")
+	configuration.Recipients.Allow = parseList(viper.GetString("Recipients_Allow"))
+	configuration.Recipients.Deny = parseList(viper.GetString("Recipients_Deny"))
+	configuration.RateLimit.Messages.User = viper.GetInt("Rate_Limit_User_Messages")
+	configuration.RateLimit.Recipients.User = viper.GetInt("Rate_Limit_User_Recipients")
+	configuration.RateLimit.Messages.Ip = viper.GetInt("Rate_Limit_Ip_Messages")
+	configuration.RateLimit.Recipients.Ip = viper.GetInt("Rate_Limit_Ip_Recipients")
+	configuration.RateLimit.Messages.Global = viper.GetInt("Rate_Limit_Global_Messages")
+	configuration.RateLimit.Recipients.Global = viper.GetInt("Rate_Limit_Global_Recipients")
+	configuration.Quota.DailyLimit = viper.GetInt("Quota_Daily_Limit")
+	configuration.Quota.StateFile = viper.GetString("Quota_State_File")
+	configuration.Lockout.IpMaxFailures = viper.GetInt("Lockout_Ip_Max_Failures")
+	configuration.Lockout.IpWindow = viper.GetDuration("Lockout_Ip_Window")
+	configuration.Lockout.IpDuration = viper.GetDuration("Lockout_Ip_Duration")
+	configuration.Lockout.UsernameMaxFailures = viper.GetInt("Lockout_Username_Max_Failures")
+	configuration.Lockout.UsernameWindow = viper.GetDuration("Lockout_Username_Window")
+	configuration.Lockout.UsernameDuration = viper.GetDuration("Lockout_Username_Duration")
+	configuration.Admin.Addr = viper.GetString("Admin_Addr")
+	configuration.Admin.Token = viper.GetString("Admin_Token")
+	configuration.Metrics.Addr = viper.GetString("Metrics_Addr")
+	configuration.Health.Addr = viper.GetString("Health_Addr")
+	configuration.Tracing.Exporter = strings.ToLower(viper.GetString("Tracing_Exporter"))
+	configuration.Tracing.Endpoint = viper.GetString("Tracing_Endpoint")
+	configuration.Tracing.File = viper.GetString("Tracing_File")
+	configuration.Tracing.SampleRatio = viper.GetFloat64("Tracing_Sample_Ratio")
+	configuration.Routing.RulesFile = viper.GetString("Routing_Rules_File")
+	configuration.Message.PreferHtml = viper.GetBool("Message_Prefer_Html")
+	configuration.Message.PersonalisationKeyTransform = viper.GetString("Message_Personalisation_Key_Transform")
+	configuration.Spool.Enabled = viper.GetBool("Spool_Enabled")
+	configuration.Spool.Dir = viper.GetString("Spool_Dir")
+	configuration.Spool.PollInterval = viper.GetDuration("Spool_Poll_Interval")
+	configuration.Spool.MaxAge = viper.GetDuration("Spool_Max_Age")
+	configuration.Retry.MaxAttempts = viper.GetInt("Retry_Max_Attempts")
+	configuration.Retry.InitialBackoff = viper.GetDuration("Retry_Initial_Backoff")
+	configuration.Retry.MaxBackoff = viper.GetDuration("Retry_Max_Backoff")
+	configuration.Delivery.Concurrency = viper.GetInt("Delivery_Concurrency")
+	configuration.Delivery.MaxConcurrency = viper.GetInt("Delivery_Max_Concurrency")
+
+	// Validate the users, either from the users file or the single configured user
+	if configuration.Auth.UsersFile != "" {
+		users, err := loadUsers(configuration.Auth.UsersFile, configuration.Notify.Hostname, configuration.Auth.AllowPlaintextPasswords)
+		if err != nil {
+			return &configuration, err
+		}
+		configuration.Auth.Users = users
+	} else if err := validateTenant(configuration.defaultTenant(), configuration.Auth.AllowPlaintextPasswords); err != nil {
+		return &configuration, err
+	}
+
+	// If TLS is enabled, validate the certificate and key file paths
+	if configuration.Smtp.UseTLS {
+		if configuration.Smtp.TlsCertFile == "" {
+			err := errors.New("TLS certificate file path must be specified")
+			return &configuration, err
+		}
+		if configuration.Smtp.TlsKeyFile == "" {
+			err := errors.New("TLS key file path must be specified")
+			return &configuration, err
+		}
+	}
+
+	// If the spool is enabled, validate the directory and poll interval
+	if configuration.Spool.Enabled {
+		if configuration.Spool.Dir == "" {
+			err := errors.New("spool directory must be specified")
+			return &configuration, err
+		}
+		if configuration.Spool.PollInterval <= 0 {
+			err := errors.New("spool poll interval must be greater than zero")
+			return &configuration, err
+		}
+	}
 
-	// Validate username is no less than three characters
-	if len(configuration.Smtp.Username) < 3 {
-		err := errors.New("username must be at least three characters")
+	// Validate there is at least one attempt to send each email
+	if configuration.Retry.MaxAttempts < 1 {
+		err := errors.New("retry max attempts must be at least one")
 		return &configuration, err
 	}
 
-	// Validate password is no less than fourteen characters
-	if len(configuration.Smtp.Password) < 14 {
-		err := errors.New("password must be at least fourteen characters")
+	// Validate the delivery concurrency
+	if configuration.Delivery.Concurrency < 1 || configuration.Delivery.MaxConcurrency < 1 {
+		err := errors.New("delivery concurrency must be at least one")
 		return &configuration, err
 	}
 
-	// Validate API key starts with gcntfy and is not less than 81 characters
-	if len(configuration.Notify.ApiKey) < 81 || configuration.Notify.ApiKey[:6] != "gcntfy" {
-		err := errors.New("API key must start with gcntfy and be at least 81 characters")
+	// Validate the Notify request timeout
+	if configuration.NotifyHttp.Timeout <= 0 {
+		err := errors.New("notify HTTP timeout must be greater than zero")
 		return &configuration, err
 	}
 
-	// Validate Notify Template ID matches a UUIDv4 using regex
-	r, _ := regexp.Compile(`^[0-9a-fA-F]{8}\-[0-9a-fA-F]{4}\-4[0-9a-fA-F]{3}\-[89abAB][0-9a-fA-F]{3}\-[0-9a-fA-F]{12}$`)
-	if !r.MatchString(configuration.Notify.TemplateId) {
-		err := errors.New("notify Template ID must be a UUIDv4")
+	// Validate the client certificate and key are specified together
+	if (configuration.NotifyHttp.ClientCertFile == "") != (configuration.NotifyHttp.ClientKeyFile == "") {
+		err := errors.New("notify client certificate and key files must be specified together")
 		return &configuration, err
 	}
 
-	// If TLS is enabled, validate the certificate and key file paths
-	if configuration.Smtp.UseTLS {
-		if configuration.Smtp.TlsCertFile == "" {
-			err := errors.New("TLS certificate file path must be specified")
+	// Validate the personalisation key transform
+	if !isValidKeyTransform(configuration.Message.PersonalisationKeyTransform) {
+		err := errors.New("personalisation key transform must be one of snake, lower or none")
+		return &configuration, err
+	}
+
+	// Validate the log level and format
+	if configuration.Log.Level, err = parseLogLevel(strings.ToLower(viper.GetString("Log_Level"))); err != nil {
+		return &configuration, err
+	}
+	if !isValidLogFormat(configuration.Log.Format) {
+		err := errors.New("log format must be json or console")
+		return &configuration, err
+	}
+	if !isValidRedaction(configuration.Log.Redaction) {
+		err := errors.New("log redaction must be none, mask or hash")
+		return &configuration, err
+	}
+
+	// The hash key has to be hard to guess, or a known address could be hashed and
+	// looked for in the logs
+	if configuration.Log.Redaction == redactionHash && len(configuration.Log.RedactionKey) < 32 {
+		err := errors.New("log redaction key must be at least 32 characters")
+		return &configuration, err
+	}
+
+	// Validate the auth mechanisms
+	if len(configuration.Auth.Mechanisms) == 0 {
+		err := errors.New("at least one auth mechanism must be enabled")
+		return &configuration, err
+	}
+	for _, mechanism := range configuration.Auth.Mechanisms {
+		if !isSupportedMechanism(mechanism) {
+			err := fmt.Errorf("auth mechanism %s is not supported, use PLAIN, LOGIN, CRAM-MD5 or SCRAM-SHA-256", mechanism)
 			return &configuration, err
 		}
-		if configuration.Smtp.TlsKeyFile == "" {
-			err := errors.New("TLS key file path must be specified")
+	}
+
+	// CRAM-MD5 can only be verified against a plaintext password
+	if slices.Contains(configuration.Auth.Mechanisms, mechanismCramMd5) && !configuration.Auth.AllowPlaintextPasswords {
+		err := errors.New("CRAM-MD5 needs plaintext passwords to be allowed")
+		return &configuration, err
+	}
+
+	// Parse the client network allow and deny lists
+	if configuration.Network.AllowCidrs, err = parseCidrs(viper.GetString("Network_Allow_Cidrs")); err != nil {
+		err := fmt.Errorf("network allow list: %s", err)
+		return &configuration, err
+	}
+	if configuration.Network.DenyCidrs, err = parseCidrs(viper.GetString("Network_Deny_Cidrs")); err != nil {
+		err := fmt.Errorf("network deny list: %s", err)
+		return &configuration, err
+	}
+
+	// Validate the recipient allow and deny lists
+	if err := configuration.Recipients.validate(); err != nil {
+		return &configuration, err
+	}
+
+	// Validate the rate limits
+	for _, limits := range []RateLimits{configuration.RateLimit.Messages, configuration.RateLimit.Recipients} {
+		if limits.User < 0 || limits.Ip < 0 || limits.Global < 0 {
+			err := errors.New("rate limits must not be negative")
+			return &configuration, err
+		}
+	}
+
+	// Validate the daily quota and parse its warning thresholds
+	if configuration.Quota.DailyLimit < 0 {
+		err := errors.New("daily quota must not be negative")
+		return &configuration, err
+	}
+	if configuration.Quota.WarnThresholds, err = parseThresholds(viper.GetString("Quota_Warn_Thresholds")); err != nil {
+		return &configuration, err
+	}
+
+	// Validate the lockout windows and durations when the lockout is enabled
+	for _, policy := range []LockoutPolicy{configuration.ipLockoutPolicy(), configuration.usernameLockoutPolicy()} {
+		if policy.MaxFailures < 0 {
+			err := errors.New("lockout max failures must not be negative")
+			return &configuration, err
+		}
+		if policy.MaxFailures > 0 && (policy.Window <= 0 || policy.Duration <= 0) {
+			err := errors.New("lockout window and duration must be greater than zero")
+			return &configuration, err
+		}
+	}
+
+	// Validate the admin token is long enough to resist guessing
+	if configuration.Admin.Addr != "" && len(configuration.Admin.Token) < 32 {
+		err := errors.New("admin token must be at least 32 characters")
+		return &configuration, err
+	}
+
+	// The metrics and health servers have no token so they can't share the admin server
+	if configuration.Metrics.Addr != "" && configuration.Metrics.Addr == configuration.Admin.Addr {
+		err := errors.New("metrics and admin servers must listen on different addresses")
+		return &configuration, err
+	}
+	if configuration.Health.Addr != "" && configuration.Health.Addr == configuration.Admin.Addr {
+		err := errors.New("health and admin servers must listen on different addresses")
+		return &configuration, err
+	}
+
+	// Validate the tracing settings
+	if !isValidTracingExporter(configuration.Tracing.Exporter) {
+		err := errors.New("tracing exporter must be none, otlp or file")
+		return &configuration, err
+	}
+	if configuration.Tracing.SampleRatio < 0 || configuration.Tracing.SampleRatio > 1 {
+		err := errors.New("tracing sample ratio must be between 0 and 1")
+		return &configuration, err
+	}
+
+	// Load and validate the template routing rules
+	if configuration.Routing.RulesFile != "" {
+		rules, err := loadTemplateRules(configuration.Routing.RulesFile)
+		if err != nil {
 			return &configuration, err
 		}
+		configuration.Routing.Rules = rules
 	}
 
 	return &configuration, err
 }
+
+func (c *Config) retryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    c.Retry.MaxAttempts,
+		InitialBackoff: c.Retry.InitialBackoff,
+		MaxBackoff:     c.Retry.MaxBackoff,
+	}
+}
+
+func (c *Config) ipLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailures: c.Lockout.IpMaxFailures,
+		Window:      c.Lockout.IpWindow,
+		Duration:    c.Lockout.IpDuration,
+	}
+}
+
+func (c *Config) usernameLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailures: c.Lockout.UsernameMaxFailures,
+		Window:      c.Lockout.UsernameWindow,
+		Duration:    c.Lockout.UsernameDuration,
+	}
+}
+
+func (c *Config) rateLimits(kind string) RateLimits {
+	if kind == rateLimitMessages {
+		return c.RateLimit.Messages
+	}
+	return c.RateLimit.Recipients
+}
+
+// secrets returns the API keys and tokens that must never be logged
+func (c *Config) secrets() []string {
+	secrets := []string{c.Notify.ApiKey, c.Admin.Token, c.Log.RedactionKey}
+	for _, tenant := range c.Auth.Users {
+		secrets = append(secrets, tenant.ApiKey)
+	}
+	return secrets
+}
+
+// notifyHostnames returns every Notify API hostname the proxy sends to
+func (c *Config) notifyHostnames() []string {
+	hostnames := []string{c.Notify.Hostname}
+	for _, tenant := range c.Auth.Users {
+		if !slices.Contains(hostnames, tenant.Hostname) {
+			hostnames = append(hostnames, tenant.Hostname)
+		}
+	}
+	return hostnames
+}
+
+func (c *Config) networkPolicy() *NetworkPolicy {
+	return &NetworkPolicy{
+		Allow: c.Network.AllowCidrs,
+		Deny:  c.Network.DenyCidrs,
+	}
+}
+
+// parseList reads a comma separated list, skipping empty entries
+func parseList(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
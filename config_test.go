@@ -50,4 +50,185 @@ func TestInitConfig(t *testing.T) {
 	viper.Set("Smtp_tls_key_file", "")
 	_, err = initConfig()
 	assert.Equal(t, "TLS key file path must be specified", err.Error())
+
+	// Test case 8: Invalid spool configuration
+	viper.Set("Smtp_tls_key_file", "valid_key_file")
+	viper.Set("Spool_Enabled", true)
+	viper.Set("Spool_Dir", "")
+	_, err = initConfig()
+	assert.Equal(t, "spool directory must be specified", err.Error())
+
+	// Test case 9: Invalid spool poll interval
+	viper.Set("Spool_Dir", "./spool")
+	viper.Set("Spool_Poll_Interval", "0s")
+	_, err = initConfig()
+	assert.Equal(t, "spool poll interval must be greater than zero", err.Error())
+
+	// Test case 10: Invalid retry attempts
+	viper.Set("Spool_Poll_Interval", "5s")
+	viper.Set("Retry_Max_Attempts", 0)
+	_, err = initConfig()
+	assert.Equal(t, "retry max attempts must be at least one", err.Error())
+
+	// Test case 11: Invalid delivery concurrency
+	viper.Set("Retry_Max_Attempts", 3)
+	viper.Set("Delivery_Concurrency", 0)
+	_, err = initConfig()
+	assert.Equal(t, "delivery concurrency must be at least one", err.Error())
+
+	// Test case 12: Invalid Notify HTTP timeout
+	viper.Set("Delivery_Concurrency", 4)
+	viper.Set("Notify_Http_Timeout", "0s")
+	_, err = initConfig()
+	assert.Equal(t, "notify HTTP timeout must be greater than zero", err.Error())
+
+	// Test case 13: Client certificate without a key
+	viper.Set("Notify_Http_Timeout", "10s")
+	viper.Set("Notify_Http_Client_Cert_File", "client.crt")
+	_, err = initConfig()
+	assert.Equal(t, "notify client certificate and key files must be specified together", err.Error())
+
+	// Test case 14: Invalid personalisation key transform
+	viper.Set("Notify_Http_Client_Cert_File", "")
+	viper.Set("Message_Personalisation_Key_Transform", "camel")
+	_, err = initConfig()
+	assert.Equal(t, "personalisation key transform must be one of snake, lower or none", err.Error())
+
+	// Test case 15: Missing template rules file
+	viper.Set("Message_Personalisation_Key_Transform", "snake")
+	viper.Set("Routing_Rules_File", "./missing_rules.yaml")
+	_, err = initConfig()
+	assert.Equal(t, "open ./missing_rules.yaml: no such file or directory", err.Error())
+
+	// Test case 16: Missing users file
+	viper.Set("Routing_Rules_File", "")
+	viper.Set("Auth_Users_File", "./missing_users.yaml")
+	_, err = initConfig()
+	assert.Equal(t, "open ./missing_users.yaml: no such file or directory", err.Error())
+
+	// Test case 17: Plaintext password without the development opt-in
+	viper.Set("Auth_Users_File", "")
+	viper.Set("Auth_Allow_Plaintext_Passwords", false)
+	_, err = initConfig()
+	assert.Equal(t, "password must be a bcrypt, argon2id or SCRAM-SHA-256 hash unless plaintext passwords are allowed", err.Error())
+
+	// Test case 18: Unsupported auth mechanism
+	viper.Set("Auth_Allow_Plaintext_Passwords", true)
+	viper.Set("Auth_Mechanisms", "PLAIN,XOAUTH2")
+	_, err = initConfig()
+	assert.Equal(t, "auth mechanism XOAUTH2 is not supported, use PLAIN, LOGIN, CRAM-MD5 or SCRAM-SHA-256", err.Error())
+
+	// Test case 19: No auth mechanism
+	viper.Set("Auth_Mechanisms", " ")
+	_, err = initConfig()
+	assert.Equal(t, "at least one auth mechanism must be enabled", err.Error())
+
+	// Test case 20: CRAM-MD5 without plaintext passwords
+	viper.Set("Auth_Mechanisms", "plain, cram-md5")
+	viper.Set("Auth_Allow_Plaintext_Passwords", false)
+	viper.Set("Smtp_Password", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy")
+	_, err = initConfig()
+	assert.Equal(t, "CRAM-MD5 needs plaintext passwords to be allowed", err.Error())
+
+	// Test case 21: Lockout without a window
+	viper.Set("Auth_Mechanisms", "PLAIN,LOGIN")
+	viper.Set("Lockout_Username_Window", "0s")
+	_, err = initConfig()
+	assert.Equal(t, "lockout window and duration must be greater than zero", err.Error())
+
+	// Test case 22: Short admin token
+	viper.Set("Lockout_Username_Window", "15m")
+	viper.Set("Admin_Addr", "127.0.0.1:8025")
+	viper.Set("Admin_Token", "short")
+	_, err = initConfig()
+	assert.Equal(t, "admin token must be at least 32 characters", err.Error())
+
+	// Test case 23: Invalid CIDR in the allow list
+	viper.Set("Admin_Addr", "")
+	viper.Set("Network_Allow_Cidrs", "10.0.0.0/8,10.0.0.0/64")
+	_, err = initConfig()
+	assert.Equal(t, "network allow list: invalid CIDR 10.0.0.0/64", err.Error())
+
+	// Test case 24: Invalid allowed sender
+	viper.Set("Network_Allow_Cidrs", "")
+	viper.Set("Auth_Allowed_Senders", "alerts@example.com, *@*.example.com")
+	_, err = initConfig()
+	assert.Equal(t, "allowed sender *@*.example.com must be an address or *@domain", err.Error())
+
+	// Test case 25: Invalid recipient deny list
+	viper.Set("Auth_Allowed_Senders", "")
+	viper.Set("Recipients_Deny", "example.com")
+	_, err = initConfig()
+	assert.Equal(t, "recipient deny list: example.com must be an address or *@domain", err.Error())
+
+	// Test case 26: Negative rate limit
+	viper.Set("Recipients_Deny", "")
+	viper.Set("Rate_Limit_Ip_Recipients", -1)
+	_, err = initConfig()
+	assert.Equal(t, "rate limits must not be negative", err.Error())
+
+	// Test case 27: Invalid quota warning threshold
+	viper.Set("Rate_Limit_Ip_Recipients", 0)
+	viper.Set("Quota_Warn_Thresholds", "80,150")
+	_, err = initConfig()
+	assert.Equal(t, "invalid quota warning threshold 150, use a percentage between 1 and 99", err.Error())
+
+	// Test case 28: Metrics and admin servers on the same address
+	viper.Set("Quota_Warn_Thresholds", "80,90")
+	viper.Set("Admin_Addr", "127.0.0.1:8025")
+	viper.Set("Admin_Token", "test-admin-token-0123456789abcdef")
+	viper.Set("Metrics_Addr", "127.0.0.1:8025")
+	_, err = initConfig()
+	assert.Equal(t, "metrics and admin servers must listen on different addresses", err.Error())
+
+	// Test case 29: Health and admin servers on the same address
+	viper.Set("Metrics_Addr", "127.0.0.1:9090")
+	viper.Set("Health_Addr", "127.0.0.1:8025")
+	_, err = initConfig()
+	assert.Equal(t, "health and admin servers must listen on different addresses", err.Error())
+
+	// Test case 30: Unsupported log level
+	viper.Set("Health_Addr", "")
+	viper.Set("Log_Level", "verbose")
+	_, err = initConfig()
+	assert.Equal(t, "log level verbose is not supported, use trace, debug, info, warn, error or disabled", err.Error())
+
+	// Test case 31: Unsupported log format
+	viper.Set("Log_Level", "debug")
+	viper.Set("Log_Format", "text")
+	_, err = initConfig()
+	assert.Equal(t, "log format must be json or console", err.Error())
+
+	// Test case 32: Unsupported log redaction
+	viper.Set("Log_Format", "console")
+	viper.Set("Log_Redaction", "blur")
+	_, err = initConfig()
+	assert.Equal(t, "log redaction must be none, mask or hash", err.Error())
+
+	// Test case 33: Hash redaction without a long enough key
+	viper.Set("Log_Redaction", "hash")
+	viper.Set("Log_Redaction_Key", "too-short")
+	_, err = initConfig()
+	assert.Equal(t, "log redaction key must be at least 32 characters", err.Error())
+
+	// Test case 34: Unsupported tracing exporter
+	viper.Set("Log_Redaction", "none")
+	viper.Set("Tracing_Exporter", "jaeger")
+	_, err = initConfig()
+	assert.Equal(t, "tracing exporter must be none, otlp or file", err.Error())
+
+	// Test case 35: Tracing sample ratio out of range
+	viper.Set("Tracing_Exporter", "otlp")
+	viper.Set("Tracing_Sample_Ratio", 1.5)
+	_, err = initConfig()
+	assert.Equal(t, "tracing sample ratio must be between 0 and 1", err.Error())
+}
+
+func TestConfig_Secrets(t *testing.T) {
+	config := &Config{}
+	config.Notify.ApiKey = "notify-api-key"
+	config.Admin.Token = "admin-token"
+	config.Auth.Users = []*Tenant{{ApiKey: "tenant-api-key"}}
+
+	assert.Equal(t, []string{"notify-api-key", "admin-token", "", "tenant-api-key"}, config.secrets())
 }
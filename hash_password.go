@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// runHashPassword prints the hash of a password read from the terminal or stdin, to
+// be used as Smtp_Password or a password in the users file
+func runHashPassword(args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	useBcrypt := flags.Bool("bcrypt", false, "use bcrypt instead of argon2id")
+	useScram := flags.Bool("scram", false, "use SCRAM-SHA-256, which also allows the SCRAM-SHA-256 mechanism")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *useBcrypt && *useScram {
+		return errors.New("only one of -bcrypt and -scram can be used")
+	}
+
+	password, err := readPassword(in)
+	if err != nil {
+		return err
+	}
+	if len(password) < 14 {
+		return errors.New("password must be at least fourteen characters")
+	}
+
+	var hash string
+	switch {
+	case *useBcrypt:
+		hash, err = hashPasswordBcrypt(password)
+	case *useScram:
+		hash, err = hashPasswordScram(password)
+	default:
+		hash, err = hashPassword(password)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, hash)
+	return err
+}
+
+// readPassword prompts for the password twice without echoing it on a terminal,
+// otherwise it reads the first line of the input
+func readPassword(in io.Reader) (string, error) {
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		confirm, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if string(password) != string(confirm) {
+			return "", errors.New("passwords do not match")
+		}
+		return string(password), nil
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHashPassword(t *testing.T) {
+	var out bytes.Buffer
+	err := runHashPassword([]string{}, strings.NewReader("longpasswordgo\n"), &out)
+	assert.Nil(t, err)
+
+	hash := strings.TrimSpace(out.String())
+	assert.True(t, isArgon2Hash(hash))
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+}
+
+func TestRunHashPassword_Bcrypt(t *testing.T) {
+	var out bytes.Buffer
+	err := runHashPassword([]string{"-bcrypt"}, strings.NewReader("longpasswordgo"), &out)
+	assert.Nil(t, err)
+
+	hash := strings.TrimSpace(out.String())
+	assert.True(t, isBcryptHash(hash))
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+}
+
+func TestRunHashPassword_ShortPassword(t *testing.T) {
+	var out bytes.Buffer
+	err := runHashPassword([]string{}, strings.NewReader("short\n"), &out)
+	assert.Equal(t, "password must be at least fourteen characters", err.Error())
+	assert.Empty(t, out.String())
+}
+
+func TestRunHashPassword_Scram(t *testing.T) {
+	var out bytes.Buffer
+	err := runHashPassword([]string{"-scram"}, strings.NewReader("longpasswordgo\n"), &out)
+	assert.Nil(t, err)
+
+	hash := strings.TrimSpace(out.String())
+	assert.True(t, isScramHash(hash))
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+
+	err = runHashPassword([]string{"-scram", "-bcrypt"}, strings.NewReader("longpasswordgo\n"), &out)
+	assert.Equal(t, "only one of -bcrypt and -scram can be used", err.Error())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long a Notify reachability check is reused for, so frequent probes don't
+// turn into a request to Notify each
+const notifyCheckInterval = 30 * time.Second
+
+// Health answers the liveness and readiness probes
+type Health struct {
+	// When the TLS certificate expires, zero without TLS. It is set before the probes
+	// are served and only read after.
+	CertExpiry time.Time
+
+	// Notify API hostnames the proxy sends to
+	Hostnames []string
+	Client    *http.Client
+
+	listening atomic.Bool
+
+	mu            sync.Mutex
+	notifyChecked time.Time
+	notifyErr     error
+	now           func() time.Time
+}
+
+// HealthResponse is the body of /healthz and /readyz
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func newHealth(client *http.Client, hostnames []string) *Health {
+	return &Health{
+		Client:    client,
+		Hostnames: hostnames,
+		now:       time.Now,
+	}
+}
+
+// Listening marks the SMTP listener as bound
+func (h *Health) Listening() {
+	h.listening.Store(true)
+}
+
+func (h *Health) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+func (h *Health) handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"smtp_listener":   "ok",
+		"tls_certificate": "ok",
+		"notify":          "ok",
+	}
+	ready := true
+
+	if !h.listening.Load() {
+		checks["smtp_listener"] = "not listening"
+		ready = false
+	}
+
+	if !h.CertExpiry.IsZero() && !h.now().Before(h.CertExpiry) {
+		checks["tls_certificate"] = fmt.Sprintf("expired at %s", h.CertExpiry.UTC().Format(time.RFC3339))
+		ready = false
+	}
+
+	if err := h.checkNotify(); err != nil {
+		checks["notify"] = err.Error()
+		ready = false
+	}
+
+	if !ready {
+		log.Warn().Interface("checks", checks).Msg("Readiness check failed")
+		writeJson(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Checks: checks})
+		return
+	}
+	writeJson(w, http.StatusOK, HealthResponse{Status: "ok", Checks: checks})
+}
+
+// checkNotify reports whether every Notify API the proxy sends to answers. Any
+// response below 500 counts, since the status endpoint doesn't need an API key.
+func (h *Health) checkNotify() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	if !h.notifyChecked.IsZero() && now.Sub(h.notifyChecked) < notifyCheckInterval {
+		return h.notifyErr
+	}
+
+	h.notifyErr = nil
+	for _, hostname := range h.Hostnames {
+		resp, err := h.Client.Get(strings.TrimSuffix(hostname, "/") + "/_status")
+		if err != nil {
+			h.notifyErr = fmt.Errorf("%s is unreachable", hostname)
+			break
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			h.notifyErr = fmt.Errorf("%s answered %d", hostname, resp.StatusCode)
+			break
+		}
+	}
+	h.notifyChecked = now
+	return h.notifyErr
+}
+
+// statusServers groups the endpoints that don't need a token by the address they
+// listen on, so metrics and health checks can share a listener
+type statusServers map[string]*http.ServeMux
+
+func (s statusServers) Handle(addr string, pattern string, handler http.Handler) {
+	if _, ok := s[addr]; !ok {
+		s[addr] = http.NewServeMux()
+	}
+	s[addr].Handle(pattern, handler)
+}
+
+func (s statusServers) start() {
+	for addr, mux := range s {
+		go startStatusServer(addr, mux)
+	}
+}
+
+func startStatusServer(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Info().Msgf("Status server listening on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal().Err(err).Msg("Status server failed")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHealth(t *testing.T, notifyStatus *int) (*Health, *time.Time, *int) {
+	requests := 0
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_status", r.URL.Path)
+		requests++
+		w.WriteHeader(*notifyStatus)
+	}))
+	t.Cleanup(notify.Close)
+
+	health := newHealth(notify.Client(), []string{notify.URL + "/"})
+	clock, now := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	health.now = clock
+	return health, now, &requests
+}
+
+func checkReady(t *testing.T, health *Health) (int, HealthResponse) {
+	w := httptest.NewRecorder()
+	health.handleReady(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var response HealthResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&response))
+	return w.Code, response
+}
+
+func TestHealth_Live(t *testing.T) {
+	health := newHealth(http.DefaultClient, nil)
+
+	w := httptest.NewRecorder()
+	health.handleLive(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestHealth_Ready(t *testing.T) {
+	notifyStatus := http.StatusOK
+	health, now, _ := newTestHealth(t, &notifyStatus)
+
+	// Not ready until the SMTP listener is bound
+	code, response := checkReady(t, health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not listening", response.Checks["smtp_listener"])
+
+	health.Listening()
+	health.CertExpiry = now.Add(time.Hour)
+	code, response = checkReady(t, health)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthResponse{Status: "ok", Checks: map[string]string{
+		"smtp_listener":   "ok",
+		"tls_certificate": "ok",
+		"notify":          "ok",
+	}}, response)
+
+	// An expired certificate fails readiness
+	*now = now.Add(2 * time.Hour)
+	code, response = checkReady(t, health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "expired at 2024-01-01T13:00:00Z", response.Checks["tls_certificate"])
+}
+
+func TestHealth_ReadyChecksNotify(t *testing.T) {
+	notifyStatus := http.StatusBadGateway
+	health, now, requests := newTestHealth(t, &notifyStatus)
+	health.Listening()
+
+	code, response := checkReady(t, health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, response.Checks["notify"], "answered 502")
+
+	// The answer is reused for a while
+	notifyStatus = http.StatusNotFound
+	code, _ = checkReady(t, health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 1, *requests)
+
+	// Any answer below 500 means Notify is reachable
+	*now = now.Add(notifyCheckInterval)
+	code, _ = checkReady(t, health)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, *requests)
+
+	health.Hostnames = []string{"http://127.0.0.1:1"}
+	*now = now.Add(notifyCheckInterval)
+	code, response = checkReady(t, health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "http://127.0.0.1:1 is unreachable", response.Checks["notify"])
+}
+
+func TestStatusServers(t *testing.T) {
+	status := statusServers{}
+	status.Handle(":9090", "/metrics", http.NotFoundHandler())
+	status.Handle(":9090", "/healthz", http.NotFoundHandler())
+	status.Handle(":8080", "/readyz", http.NotFoundHandler())
+
+	// Handlers on the same address share a server
+	assert.Len(t, status, 2)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// runHealthcheck probes the health server of a running proxy, so a scratch image
+// without curl can use it as its HEALTHCHECK
+func runHealthcheck(args []string, out io.Writer) error {
+	viper.AutomaticEnv()
+
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	addr := flags.String("addr", viper.GetString("Health_Addr"), "address of the health server, defaults to HEALTH_ADDR")
+	live := flags.Bool("live", false, "check /healthz instead of /readyz")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for an answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *addr == "" {
+		return errors.New("the health server address must be set with -addr or HEALTH_ADDR")
+	}
+
+	path := "/readyz"
+	if *live {
+		path = "/healthz"
+	}
+
+	resp, err := (&http.Client{Timeout: *timeout}).Get(localUrl(*addr) + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	_, err = fmt.Fprintln(out, strings.TrimSpace(string(body)))
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHealthcheck(t *testing.T) {
+	health := newHealth(http.DefaultClient, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.handleLive)
+	mux.HandleFunc("/readyz", health.handleReady)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var out bytes.Buffer
+	err := runHealthcheck([]string{"-addr", server.URL, "-live"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"status\":\"ok\"}\n", out.String())
+
+	// The SMTP listener was never bound
+	err = runHealthcheck([]string{"-addr", server.URL}, &out)
+	assert.Contains(t, err.Error(), "unexpected status code: 503")
+
+	health.Listening()
+	out.Reset()
+	err = runHealthcheck([]string{"-addr", server.URL}, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `"status":"ok"`)
+
+	err = runHealthcheck([]string{"-addr", ""}, &out)
+	assert.Equal(t, "the health server address must be set with -addr or HEALTH_ADDR", err.Error())
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Matches runs of blank lines left behind by nested block elements
+var blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+type markdownList struct {
+	ordered bool
+	count   int
+}
+
+type markdownWriter struct {
+	b     strings.Builder
+	lists []*markdownList
+}
+
+// htmlToMarkdown converts an HTML email body to the markdown supported by Notify
+func htmlToMarkdown(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	w := &markdownWriter{}
+	w.walk(doc)
+
+	// Clean up trailing spaces and extra blank lines
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	markdown := blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return strings.TrimSpace(markdown), nil
+}
+
+// write adds inline content, dropping a leading space at the start of a line
+func (w *markdownWriter) write(s string) {
+	current := w.b.String()
+	if strings.HasPrefix(s, " ") && (current == "" || strings.HasSuffix(current, "\n") || strings.HasSuffix(current, " ")) {
+		s = strings.TrimLeft(s, " ")
+	}
+	w.b.WriteString(s)
+}
+
+// text adds a text node with its whitespace collapsed the way a browser would
+func (w *markdownWriter) text(s string) {
+	if s == "" {
+		return
+	}
+
+	collapsed := strings.Join(strings.Fields(s), " ")
+	if strings.TrimSpace(s) == "" {
+		w.write(" ")
+		return
+	}
+	if strings.TrimLeft(s, " \t\r\n") != s {
+		collapsed = " " + collapsed
+	}
+	if strings.TrimRight(s, " \t\r\n") != s {
+		collapsed = collapsed + " "
+	}
+	w.write(collapsed)
+}
+
+func (w *markdownWriter) newline() {
+	current := w.b.String()
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		w.b.WriteString("\n")
+	}
+}
+
+// block separates block elements with a blank line, except inside a list item
+// where a blank line would end the item
+func (w *markdownWriter) block() {
+	if len(w.lists) > 0 {
+		w.write(" ")
+		return
+	}
+
+	w.newline()
+	current := w.b.String()
+	if current != "" && !strings.HasSuffix(current, "\n\n") {
+		w.b.WriteString("\n")
+	}
+}
+
+// inline renders the children of a node on a single line
+func (w *markdownWriter) inline(n *html.Node) string {
+	child := &markdownWriter{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		child.walk(c)
+	}
+	return strings.Join(strings.Fields(child.b.String()), " ")
+}
+
+func (w *markdownWriter) walkChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+func (w *markdownWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.walkChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title:
+		return
+	case atom.Br:
+		w.newline()
+	case atom.Hr:
+		w.block()
+		w.write("---")
+		w.block()
+	case atom.H1:
+		w.block()
+		w.write("# " + w.inline(n))
+		w.block()
+	case atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block()
+		w.write("## " + w.inline(n))
+		w.block()
+	case atom.Blockquote:
+		w.block()
+		w.write("^ " + w.inline(n))
+		w.block()
+	case atom.Pre:
+		w.block()
+		w.b.WriteString(strings.Trim(textContent(n), "\n"))
+		w.block()
+	case atom.Strong, atom.B:
+		if text := w.inline(n); text != "" {
+			w.write("**" + text + "**")
+		}
+	case atom.Em, atom.I:
+		if text := w.inline(n); text != "" {
+			w.write("*" + text + "*")
+		}
+	case atom.A:
+		w.link(n)
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			w.text(alt)
+		}
+	case atom.Ul, atom.Ol:
+		w.list(n)
+	case atom.Li:
+		w.listItem(n)
+	case atom.Table:
+		w.table(n)
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Center, atom.Address:
+		w.block()
+		w.walkChildren(n)
+		w.block()
+	default:
+		w.walkChildren(n)
+	}
+}
+
+func (w *markdownWriter) link(n *html.Node) {
+	text := w.inline(n)
+	href := strings.TrimSpace(attr(n, "href"))
+
+	switch {
+	case href == "" || strings.HasPrefix(href, "#"):
+		w.write(text)
+	case text == "" || text == href || text == strings.TrimPrefix(href, "mailto:"):
+		w.write(strings.TrimPrefix(href, "mailto:"))
+	default:
+		w.write(fmt.Sprintf("[%s](%s)", text, href))
+	}
+}
+
+func (w *markdownWriter) list(n *html.Node) {
+	if len(w.lists) == 0 {
+		w.block()
+	} else {
+		w.newline()
+	}
+
+	w.lists = append(w.lists, &markdownList{ordered: n.DataAtom == atom.Ol})
+	w.walkChildren(n)
+	w.lists = w.lists[:len(w.lists)-1]
+
+	if len(w.lists) == 0 {
+		w.block()
+	} else {
+		w.newline()
+	}
+}
+
+func (w *markdownWriter) listItem(n *html.Node) {
+	if len(w.lists) == 0 {
+		w.walkChildren(n)
+		return
+	}
+
+	list := w.lists[len(w.lists)-1]
+	list.count++
+
+	marker := "* "
+	if list.ordered {
+		marker = fmt.Sprintf("%d. ", list.count)
+	}
+
+	w.newline()
+	w.b.WriteString(strings.Repeat("  ", len(w.lists)-1) + marker)
+	w.walkChildren(n)
+	w.newline()
+}
+
+// table renders each row on its own line with the cells separated by pipes. Tables
+// used for layout are rendered cell by cell instead so their content is kept.
+func (w *markdownWriter) table(n *html.Node) {
+	w.block()
+	layout := isLayoutTable(n)
+	for _, row := range tableRows(n) {
+		if layout {
+			for c := row.FirstChild; c != nil; c = c.NextSibling {
+				w.block()
+				w.walk(c)
+				w.block()
+			}
+			continue
+		}
+
+		cells := []string{}
+		for c := row.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) {
+				continue
+			}
+
+			text := w.inline(c)
+			if c.DataAtom == atom.Th && text != "" {
+				text = "**" + text + "**"
+			}
+			cells = append(cells, text)
+		}
+
+		if strings.TrimSpace(strings.Join(cells, "")) == "" {
+			continue
+		}
+		w.newline()
+		w.b.WriteString(strings.Join(cells, " | "))
+		w.newline()
+	}
+	w.block()
+}
+
+// isLayoutTable reports whether any cell of the table holds block content
+func isLayoutTable(n *html.Node) bool {
+	for _, row := range tableRows(n) {
+		for c := row.FirstChild; c != nil; c = c.NextSibling {
+			if hasBlockContent(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasBlockContent(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Table, atom.P, atom.Div, atom.Ul, atom.Ol, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Pre:
+			return true
+		}
+		if hasBlockContent(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// tableRows returns the rows of a table without descending into nested tables
+func tableRows(n *html.Node) []*html.Node {
+	rows := []*html.Node{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			rows = append(rows, tableRows(c)...)
+		}
+	}
+	return rows
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHtmlToMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		html     string
+		markdown string
+	}{
+		{
+			name:     "paragraphs",
+			html:     "<html><head><title>Ignored</title><style>p { color: red; }</style></head><body><p>First   paragraph</p><p>Second<br>line</p></body></html>",
+			markdown: "First paragraph\n\nSecond\nline",
+		},
+		{
+			name:     "headings",
+			html:     "<h1>Title</h1><h2>Sub <em>title</em></h2><h4>Small</h4><p>Text</p>",
+			markdown: "# Title\n\n## Sub *title*\n\n## Small\n\nText",
+		},
+		{
+			name:     "emphasis",
+			html:     "<p>Some <strong>bold</strong>, <b>bold</b> and <i>italic</i> text</p>",
+			markdown: "Some **bold**, **bold** and *italic* text",
+		},
+		{
+			name:     "links",
+			html:     `<p>Visit <a href="https://canada.ca">Canada.ca</a>, <a href="https://example.com">https://example.com</a>, <a href="mailto:test@test.com">test@test.com</a> or <a href="#top">the top</a></p>`,
+			markdown: "Visit [Canada.ca](https://canada.ca), https://example.com, test@test.com or the top",
+		},
+		{
+			name:     "lists",
+			html:     "<p>Steps:</p><ol><li>One</li><li><p>Two</p></li></ol><ul><li>Apple<ul><li>Green</li></ul></li><li>Pear</li></ul>",
+			markdown: "Steps:\n\n1. One\n2. Two\n\n* Apple\n  * Green\n* Pear",
+		},
+		{
+			name:     "tables",
+			html:     "<table><thead><tr><th>Name</th><th>Status</th></tr></thead><tbody><tr><td>Build</td><td>Passed</td></tr><tr><td>Deploy</td><td><b>Failed</b></td></tr></tbody></table>",
+			markdown: "**Name** | **Status**\nBuild | Passed\nDeploy | **Failed**",
+		},
+		{
+			name:     "layout tables",
+			html:     "<table><tr><td><h1>Alert</h1><p>CPU is high</p></td></tr><tr><td><p>Footer</p></td></tr></table>",
+			markdown: "# Alert\n\nCPU is high\n\nFooter",
+		},
+		{
+			name:     "entities and images",
+			html:     `<p>Fish &amp; chips <img src="logo.png" alt="Logo"></p>`,
+			markdown: "Fish & chips Logo",
+		},
+		{
+			name:     "blockquote and rule",
+			html:     "<blockquote>Quoted text</blockquote><hr><p>After</p>",
+			markdown: "^ Quoted text\n\n---\n\nAfter",
+		},
+		{
+			name:     "preformatted",
+			html:     "<pre>line 1\n  line 2</pre>",
+			markdown: "line 1\n  line 2",
+		},
+	}
+
+	for _, test := range tests {
+		markdown, err := htmlToMarkdown(test.html)
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.markdown, markdown, test.name)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newHttpClient returns the HTTP client shared by every request to Notify so
+// that connections are kept alive and reused between messages
+func newHttpClient(config *Config) (*http.Client, error) {
+	tlsConfig, err := newNotifyTlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.NotifyHttp.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   config.NotifyHttp.TlsHandshakeTimeout,
+		MaxIdleConns:          config.NotifyHttp.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.NotifyHttp.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.NotifyHttp.MaxConnsPerHost,
+		IdleConnTimeout:       config.NotifyHttp.IdleConnTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   config.NotifyHttp.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// newNotifyTlsConfig trusts the system roots plus an optional CA bundle, which is
+// needed when egress goes through a proxy that inspects TLS traffic
+func newNotifyTlsConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.NotifyHttp.CaFile != "" {
+		pem, err := os.ReadFile(config.NotifyHttp.CaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.NotifyHttp.ClientCertFile != "" {
+		cer, err := tls.LoadX509KeyPair(config.NotifyHttp.ClientCertFile, config.NotifyHttp.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cer}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHttpClient(t *testing.T) {
+	config := &Config{}
+	config.NotifyHttp.Timeout = 5 * time.Second
+	config.NotifyHttp.ConnectTimeout = time.Second
+	config.NotifyHttp.TlsHandshakeTimeout = 2 * time.Second
+	config.NotifyHttp.MaxIdleConns = 50
+	config.NotifyHttp.MaxIdleConnsPerHost = 10
+	config.NotifyHttp.MaxConnsPerHost = 20
+
+	client, err := newHttpClient(config)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+
+	transport := client.Transport.(*http.Transport)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 50, transport.MaxIdleConns)
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 20, transport.MaxConnsPerHost)
+	assert.Nil(t, transport.TLSClientConfig.RootCAs)
+}
+
+func TestNewHttpClient_TrustsCaFile(t *testing.T) {
+	mockServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	// Without the CA bundle the mock server's certificate is not trusted
+	config := &Config{}
+	config.NotifyHttp.Timeout = 5 * time.Second
+
+	client, err := newHttpClient(config)
+	assert.Nil(t, err)
+	_, err = client.Post(mockServer.URL, "application/json", nil)
+	assert.NotNil(t, err)
+
+	// Write the mock server's certificate to a CA bundle
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(caFile, caPem, 0600))
+	config.NotifyHttp.CaFile = caFile
+
+	client, err = newHttpClient(config)
+	assert.Nil(t, err)
+	resp, err := client.Post(mockServer.URL, "application/json", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestNewHttpClient_InvalidCaFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.Nil(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	config := &Config{}
+	config.NotifyHttp.CaFile = caFile
+
+	_, err := newHttpClient(config)
+	assert.Equal(t, "no certificates found in CA file", err.Error())
+}
+
+func TestNewHttpClient_ClientCertificate(t *testing.T) {
+	config := &Config{}
+	config.NotifyHttp.ClientCertFile = "./example_certs/server.crt"
+	config.NotifyHttp.ClientKeyFile = "./example_certs/server.key"
+
+	client, err := newHttpClient(config)
+	assert.Nil(t, err)
+	assert.Len(t, client.Transport.(*http.Transport).TLSClientConfig.Certificates, 1)
+
+	config.NotifyHttp.ClientKeyFile = "./example_certs/missing.key"
+	_, err = newHttpClient(config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy locks a client out for Duration after MaxFailures failed logins
+// within Window, a MaxFailures of 0 disables the lockout
+type LockoutPolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	Duration    time.Duration
+}
+
+// LockoutEntry is a locked out remote IP or username
+type LockoutEntry struct {
+	Kind        string    `json:"kind"`
+	Value       string    `json:"value"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Lockout counts failed logins per remote IP and per username over a sliding window
+type Lockout struct {
+	Ip       LockoutPolicy
+	Username LockoutPolicy
+
+	mu          sync.Mutex
+	failures    map[string][]time.Time
+	lockedUntil map[string]time.Time
+	lastPrune   time.Time
+	now         func() time.Time
+}
+
+const (
+	lockoutKindIp       = "ip"
+	lockoutKindUsername = "username"
+)
+
+func newLockout(ip LockoutPolicy, username LockoutPolicy) *Lockout {
+	return &Lockout{
+		Ip:          ip,
+		Username:    username,
+		failures:    map[string][]time.Time{},
+		lockedUntil: map[string]time.Time{},
+		now:         time.Now,
+	}
+}
+
+func lockoutKey(kind string, value string) string {
+	if kind == lockoutKindUsername {
+		value = strings.ToLower(value)
+	}
+	return kind + ":" + value
+}
+
+// IpLocked returns how much longer the remote IP is locked out for, or zero
+func (l *Lockout) IpLocked(ip string) time.Duration {
+	return l.locked(lockoutKindIp, ip)
+}
+
+// UsernameLocked returns how much longer the username is locked out for, or zero
+func (l *Lockout) UsernameLocked(username string) time.Duration {
+	return l.locked(lockoutKindUsername, username)
+}
+
+func (l *Lockout) locked(kind string, value string) time.Duration {
+	if l == nil || value == "" {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := lockoutKey(kind, value)
+	remaining := l.lockedUntil[key].Sub(l.now())
+	if remaining <= 0 {
+		delete(l.lockedUntil, key)
+		return 0
+	}
+	return remaining
+}
+
+// Failure records a failed login and returns the entries it locked out
+func (l *Lockout) Failure(ip string, username string) []LockoutEntry {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	locked := []LockoutEntry{}
+	if entry, ok := l.record(lockoutKindIp, ip, l.Ip, now); ok {
+		locked = append(locked, entry)
+	}
+	if entry, ok := l.record(lockoutKindUsername, username, l.Username, now); ok {
+		locked = append(locked, entry)
+	}
+	return locked
+}
+
+func (l *Lockout) record(kind string, value string, policy LockoutPolicy, now time.Time) (LockoutEntry, bool) {
+	if value == "" || policy.MaxFailures <= 0 {
+		return LockoutEntry{}, false
+	}
+
+	key := lockoutKey(kind, value)
+	failures := append(recentFailures(l.failures[key], now, policy.Window), now)
+
+	if len(failures) < policy.MaxFailures {
+		l.failures[key] = failures
+		return LockoutEntry{}, false
+	}
+
+	delete(l.failures, key)
+	l.lockedUntil[key] = now.Add(policy.Duration)
+	return LockoutEntry{Kind: kind, Value: value, LockedUntil: l.lockedUntil[key]}, true
+}
+
+// Success clears the failed logins of a username, the remote IP keeps its count so a
+// valid account can't be used to reset it
+func (l *Lockout) Success(username string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, lockoutKey(lockoutKindUsername, username))
+}
+
+// Unlock clears the lockout and failed logins of a remote IP or username, and reports
+// whether it was locked out
+func (l *Lockout) Unlock(kind string, value string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := lockoutKey(kind, value)
+	until, ok := l.lockedUntil[key]
+	locked := ok && until.After(l.now())
+	delete(l.lockedUntil, key)
+	delete(l.failures, key)
+	return locked
+}
+
+// List returns the current lockouts, ordered by when they end
+func (l *Lockout) List() []LockoutEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	entries := []LockoutEntry{}
+	for key, until := range l.lockedUntil {
+		if !until.After(now) {
+			continue
+		}
+		kind, value, _ := strings.Cut(key, ":")
+		entries = append(entries, LockoutEntry{Kind: kind, Value: value, LockedUntil: until})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LockedUntil.Before(entries[j].LockedUntil)
+	})
+	return entries
+}
+
+// prune drops expired lockouts and old failures once per window, so spraying many
+// usernames doesn't grow the maps forever
+func (l *Lockout) prune(now time.Time) {
+	window := max(l.Ip.Window, l.Username.Window)
+	if now.Sub(l.lastPrune) < window {
+		return
+	}
+	l.lastPrune = now
+
+	for key, until := range l.lockedUntil {
+		if !until.After(now) {
+			delete(l.lockedUntil, key)
+		}
+	}
+	for key, failures := range l.failures {
+		if failures = recentFailures(failures, now, window); len(failures) == 0 {
+			delete(l.failures, key)
+		} else {
+			l.failures[key] = failures
+		}
+	}
+}
+
+// recentFailures keeps the failures within the window
+func recentFailures(failures []time.Time, now time.Time, window time.Duration) []time.Time {
+	recent := failures[:0]
+	for _, failure := range failures {
+		if now.Sub(failure) < window {
+			recent = append(recent, failure)
+		}
+	}
+	return recent
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClock returns a now function for the types that read the time through one,
+// and the time it reads so a test can move it
+func newTestClock(start time.Time) (func() time.Time, *time.Time) {
+	now := start
+	return func() time.Time { return now }, &now
+}
+
+func newTestLockout() (*Lockout, *time.Time) {
+	lockout := newLockout(
+		LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: 10 * time.Minute},
+		LockoutPolicy{MaxFailures: 2, Window: time.Minute, Duration: 5 * time.Minute},
+	)
+	clock, now := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	lockout.now = clock
+	return lockout, now
+}
+
+func TestLockout_LocksUsername(t *testing.T) {
+	lockout, now := newTestLockout()
+
+	assert.Empty(t, lockout.Failure("10.0.0.1", "grafana"))
+	locked := lockout.Failure("10.0.0.2", "Grafana")
+	assert.Equal(t, []LockoutEntry{{Kind: "username", Value: "Grafana", LockedUntil: now.Add(5 * time.Minute)}}, locked)
+
+	assert.Equal(t, 5*time.Minute, lockout.UsernameLocked("grafana"))
+	assert.Equal(t, time.Duration(0), lockout.IpLocked("10.0.0.1"))
+
+	// The lockout ends after its duration
+	*now = now.Add(5 * time.Minute)
+	assert.Equal(t, time.Duration(0), lockout.UsernameLocked("grafana"))
+}
+
+func TestLockout_LocksIp(t *testing.T) {
+	lockout, now := newTestLockout()
+
+	// Spraying different usernames from one IP
+	lockout.Failure("10.0.0.1", "user1")
+	lockout.Failure("10.0.0.1", "user2")
+	locked := lockout.Failure("10.0.0.1", "user3")
+	assert.Equal(t, []LockoutEntry{{Kind: "ip", Value: "10.0.0.1", LockedUntil: now.Add(10 * time.Minute)}}, locked)
+	assert.Equal(t, 10*time.Minute, lockout.IpLocked("10.0.0.1"))
+}
+
+func TestLockout_SlidingWindow(t *testing.T) {
+	lockout, now := newTestLockout()
+
+	lockout.Failure("10.0.0.1", "grafana")
+	*now = now.Add(time.Minute)
+
+	// The first failure is outside the window, so this is the only one counted
+	assert.Empty(t, lockout.Failure("10.0.0.1", "grafana"))
+	assert.Equal(t, time.Duration(0), lockout.UsernameLocked("grafana"))
+}
+
+func TestLockout_SuccessClearsUsernameFailures(t *testing.T) {
+	lockout, _ := newTestLockout()
+
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Success("grafana")
+	assert.Empty(t, lockout.Failure("10.0.0.2", "grafana"))
+
+	// The IP keeps counting
+	locked := lockout.Failure("10.0.0.1", "jira")
+	assert.Empty(t, locked)
+	locked = lockout.Failure("10.0.0.1", "other")
+	assert.Len(t, locked, 1)
+	assert.Equal(t, "ip", locked[0].Kind)
+}
+
+func TestLockout_UnlockAndList(t *testing.T) {
+	lockout, now := newTestLockout()
+
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Failure("10.0.0.1", "jira")
+
+	assert.Equal(t, []LockoutEntry{
+		{Kind: "username", Value: "grafana", LockedUntil: now.Add(5 * time.Minute)},
+		{Kind: "ip", Value: "10.0.0.1", LockedUntil: now.Add(10 * time.Minute)},
+	}, lockout.List())
+
+	assert.True(t, lockout.Unlock("username", "GRAFANA"))
+	assert.False(t, lockout.Unlock("username", "grafana"))
+	assert.True(t, lockout.Unlock("ip", "10.0.0.1"))
+	assert.Empty(t, lockout.List())
+}
+
+func TestLockout_Disabled(t *testing.T) {
+	lockout := newLockout(LockoutPolicy{}, LockoutPolicy{})
+	for i := 0; i < 100; i++ {
+		assert.Empty(t, lockout.Failure("10.0.0.1", "grafana"))
+	}
+
+	// A nil lockout never locks anyone out
+	var none *Lockout
+	assert.Nil(t, none.Failure("10.0.0.1", "grafana"))
+	assert.Equal(t, time.Duration(0), none.IpLocked("10.0.0.1"))
+	none.Success("grafana")
+}
+
+func TestLockout_Prune(t *testing.T) {
+	lockout, now := newTestLockout()
+
+	lockout.Failure("10.0.0.1", "user1")
+	*now = now.Add(2 * time.Minute)
+	lockout.Failure("10.0.0.2", "user2")
+
+	assert.Len(t, lockout.failures, 2)
+	assert.NotContains(t, lockout.failures, "username:user1")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Log formats that can be set with Log_Format
+const (
+	logFormatJson    = "json"
+	logFormatConsole = "console"
+)
+
+// logOutput is where every logger writes. The format is switched by swapping the
+// writer behind it, since loggers made from log.Logger keep their own copy of it.
+var logOutput = &switchWriter{out: os.Stderr, format: logFormatJson}
+
+type switchWriter struct {
+	mu     sync.RWMutex
+	out    io.Writer
+	format string
+
+	// Values that must never reach the logs, such as API keys
+	secrets [][]byte
+}
+
+func (w *switchWriter) Write(p []byte) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	line := p
+	for _, secret := range w.secrets {
+		line = bytes.ReplaceAll(line, secret, []byte("[redacted]"))
+	}
+	if _, err := w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// hide replaces the secrets with [redacted] in every log line, as a last line of
+// defence if one ends up in an error message
+func (w *switchWriter) hide(secrets ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, secret := range secrets {
+		if secret != "" {
+			w.secrets = append(w.secrets, []byte(secret))
+		}
+	}
+}
+
+func (w *switchWriter) set(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.format = format
+	if format == logFormatConsole {
+		w.out = zerolog.ConsoleWriter{Out: os.Stderr}
+	} else {
+		w.out = os.Stderr
+	}
+}
+
+func (w *switchWriter) Format() string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.format
+}
+
+// parseLogLevel reads a level such as info or debug
+func parseLogLevel(value string) (zerolog.Level, error) {
+	level, err := zerolog.ParseLevel(value)
+	if err != nil || value == "" || level == zerolog.NoLevel {
+		return zerolog.NoLevel, fmt.Errorf("log level %s is not supported, use trace, debug, info, warn, error or disabled", value)
+	}
+	return level, nil
+}
+
+func isValidLogFormat(format string) bool {
+	return format == logFormatJson || format == logFormatConsole
+}
+
+// setupLogging applies the configured log level and format
+func setupLogging(level zerolog.Level, format string) {
+	log.Logger = zerolog.New(logOutput).With().Timestamp().Logger()
+	logOutput.set(format)
+	zerolog.SetGlobalLevel(level)
+}
+
+// handleLogSignals switches between debug logging and the configured level on SIGUSR1
+func handleLogSignals(configured zerolog.Level) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		level := zerolog.DebugLevel
+		if zerolog.GlobalLevel() == zerolog.DebugLevel {
+			level = configured
+		}
+		zerolog.SetGlobalLevel(level)
+		log.WithLevel(zerolog.NoLevel).Str("event", "log_level_changed").Str("level", level.String()).Msgf("Log level set to %s", level)
+	}
+}
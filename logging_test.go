@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := parseLogLevel("debug")
+	assert.Nil(t, err)
+	assert.Equal(t, zerolog.DebugLevel, level)
+
+	level, err = parseLogLevel("disabled")
+	assert.Nil(t, err)
+	assert.Equal(t, zerolog.Disabled, level)
+
+	for _, value := range []string{"", "verbose"} {
+		_, err = parseLogLevel(value)
+		assert.Equal(t, "log level "+value+" is not supported, use trace, debug, info, warn, error or disabled", err.Error())
+	}
+}
+
+func TestIsValidLogFormat(t *testing.T) {
+	assert.True(t, isValidLogFormat("json"))
+	assert.True(t, isValidLogFormat("console"))
+	assert.False(t, isValidLogFormat("text"))
+	assert.False(t, isValidLogFormat(""))
+}
+
+func TestSwitchWriter(t *testing.T) {
+	writer := &switchWriter{out: os.Stderr, format: logFormatJson}
+
+	writer.set(logFormatConsole)
+	assert.Equal(t, logFormatConsole, writer.Format())
+	assert.IsType(t, zerolog.ConsoleWriter{}, writer.out)
+
+	writer.set(logFormatJson)
+	assert.Equal(t, logFormatJson, writer.Format())
+	assert.Equal(t, os.Stderr, writer.out)
+}
+
+func TestSwitchWriter_Hide(t *testing.T) {
+	var out bytes.Buffer
+	writer := &switchWriter{out: &out, format: logFormatJson}
+	writer.hide("gcntfy-secret-key", "")
+
+	line := []byte(`{"message":"Error sending email: gcntfy-secret-key"}` + "\n")
+	n, err := writer.Write(line)
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	assert.Equal(t, `{"message":"Error sending email: [redacted]"}`+"\n", out.String())
+}
@@ -1,8 +1,33 @@
 package main
 
-import "github.com/rs/zerolog/log"
+import (
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
 
 func main() {
+	// Run a subcommand instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			if err := runHashPassword(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				log.Fatal().Msgf("Error hashing password: %s", err)
+			}
+			return
+		case "healthcheck":
+			if err := runHealthcheck(os.Args[2:], os.Stdout); err != nil {
+				log.Fatal().Msgf("Health check failed: %s", err)
+			}
+			return
+		case "unlock":
+			if err := runUnlock(os.Args[2:], os.Stdout); err != nil {
+				log.Fatal().Msgf("Error unlocking: %s", err)
+			}
+			return
+		}
+	}
+
 	// Initialize configuration
 	config, err := initConfig()
 
@@ -10,6 +35,19 @@ func main() {
 		log.Fatal().Msgf("Error initializing configuration: %s", err)
 	}
 
+	// Apply the log settings before anything else logs
+	setupLogging(config.Log.Level, config.Log.Format)
+	logOutput.hide(config.secrets()...)
+	logRedactor = newRedactor(config.Log.Redaction, config.Log.RedactionKey)
+
+	// Export spans of SMTP sessions and Notify requests
+	shutdownTracing, err := setupTracing(config)
+	if err != nil {
+		log.Fatal().Msgf("Error setting up tracing: %s", err)
+	}
+	go flushTracesOnExit(shutdownTracing)
+	go handleLogSignals(config.Log.Level)
+
 	// Start the SMTP server
 	startSmtpServer(config)
 }
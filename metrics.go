@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus metrics of the proxy. The methods do nothing on a nil
+// Metrics so sessions and clients don't need to check whether metrics are enabled.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	connections     prometheus.Counter
+	auths           *prometheus.CounterVec
+	messages        *prometheus.CounterVec
+	recipients      prometheus.Counter
+	attachmentBytes prometheus.Histogram
+	notifyRequests  *prometheus.HistogramVec
+	notifyRetries   prometheus.Counter
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_proxy_connections_total",
+			Help: "SMTP connections accepted by the network policy.",
+		}),
+		auths: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_proxy_auth_total",
+			Help: "SMTP logins, by result.",
+		}, []string{"result"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_proxy_messages_total",
+			Help: "Messages accepted or rejected.",
+		}, []string{"result"}),
+		recipients: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_proxy_recipients_total",
+			Help: "Recipients accepted, including Cc and Bcc addresses.",
+		}),
+		attachmentBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "smtp_proxy_attachment_bytes",
+			Help:    "Size of the attachments in accepted messages.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+		notifyRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smtp_proxy_notify_request_duration_seconds",
+			Help:    "Latency of Notify API requests, by status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"status_code"}),
+		notifyRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_proxy_notify_retries_total",
+			Help: "Notify API requests retried after a temporary failure.",
+		}),
+	}
+
+	m.Registry.MustRegister(
+		m.connections,
+		m.auths,
+		m.messages,
+		m.recipients,
+		m.attachmentBytes,
+		m.notifyRequests,
+		m.notifyRetries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) Connection() {
+	if m != nil {
+		m.connections.Inc()
+	}
+}
+
+func (m *Metrics) Auth(success bool) {
+	if m != nil {
+		m.auths.WithLabelValues(result(success, "success", "failure")).Inc()
+	}
+}
+
+// Message counts a message as accepted when the reply to it is a success
+func (m *Metrics) Message(err error) {
+	if m != nil {
+		m.messages.WithLabelValues(result(isAccepted(err), "accepted", "rejected")).Inc()
+	}
+}
+
+func (m *Metrics) Recipients(n int) {
+	if m != nil {
+		m.recipients.Add(float64(n))
+	}
+}
+
+func (m *Metrics) AttachmentBytes(n int) {
+	if m != nil {
+		m.attachmentBytes.Observe(float64(n))
+	}
+}
+
+// NotifyRequest records the latency of a Notify request, a status code of 0 means
+// there was no response
+func (m *Metrics) NotifyRequest(statusCode int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	status := "error"
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	m.notifyRequests.WithLabelValues(status).Observe(duration.Seconds())
+}
+
+func (m *Metrics) NotifyRetry() {
+	if m != nil {
+		m.notifyRetries.Inc()
+	}
+}
+
+// RegisterSpool reports the number of messages waiting in the spool
+func (m *Metrics) RegisterSpool(spool *Spool) {
+	if m == nil {
+		return
+	}
+	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "smtp_proxy_spool_depth",
+		Help: "Messages waiting in the spool.",
+	}, func() float64 {
+		ids, err := spool.List()
+		if err != nil {
+			return 0
+		}
+		return float64(len(ids))
+	}))
+}
+
+// RegisterQuota reports the notifications sent with each API key today
+func (m *Metrics) RegisterQuota(quota *Quota) {
+	if m != nil {
+		m.Registry.MustRegister(&quotaCollector{quota: quota})
+	}
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// quotaCollector reads the daily counts when scraped, so a key that isn't used after
+// midnight drops back to zero
+type quotaCollector struct {
+	quota *Quota
+}
+
+var quotaCountDesc = prometheus.NewDesc(
+	"smtp_proxy_daily_quota_count",
+	"Notifications sent with each Notify API key today, UTC.",
+	[]string{"api_key"}, nil,
+)
+
+func (c *quotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaCountDesc
+}
+
+func (c *quotaCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, count := range c.quota.State().Counts {
+		ch <- prometheus.MustNewConstMetric(quotaCountDesc, prometheus.GaugeValue, float64(count), name)
+	}
+}
+
+func result(ok bool, success string, failure string) string {
+	if ok {
+		return success
+	}
+	return failure
+}
+
+// isAccepted reports whether the reply to a message is a success, which includes a
+// queued reply and a partial delivery
+func isAccepted(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return err == nil || (errors.As(err, &smtpErr) && smtpErr.Code < 400)
+}
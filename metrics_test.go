@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T, metrics *Metrics) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body, err := io.ReadAll(w.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := newMetrics()
+	metrics.Connection()
+	metrics.Auth(true)
+	metrics.Auth(false)
+	metrics.Auth(false)
+	metrics.Message(nil)
+	metrics.Message(queuedReply("queue-id"))
+	metrics.Message(errRateLimited)
+	metrics.Recipients(3)
+	metrics.AttachmentBytes(2048)
+	metrics.NotifyRequest(201, 50*time.Millisecond)
+	metrics.NotifyRequest(0, time.Second)
+	metrics.NotifyRetry()
+
+	body := scrapeMetrics(t, metrics)
+	assert.Contains(t, body, "smtp_proxy_connections_total 1\n")
+	assert.Contains(t, body, `smtp_proxy_auth_total{result="success"} 1`)
+	assert.Contains(t, body, `smtp_proxy_auth_total{result="failure"} 2`)
+	assert.Contains(t, body, `smtp_proxy_messages_total{result="accepted"} 2`)
+	assert.Contains(t, body, `smtp_proxy_messages_total{result="rejected"} 1`)
+	assert.Contains(t, body, "smtp_proxy_recipients_total 3\n")
+	assert.Contains(t, body, "smtp_proxy_attachment_bytes_sum 2048\n")
+	assert.Contains(t, body, `smtp_proxy_notify_request_duration_seconds_count{status_code="201"} 1`)
+	assert.Contains(t, body, `smtp_proxy_notify_request_duration_seconds_count{status_code="error"} 1`)
+	assert.Contains(t, body, "smtp_proxy_notify_retries_total 1\n")
+}
+
+func TestMetrics_SpoolAndQuota(t *testing.T) {
+	metrics := newMetrics()
+
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	_, err = spool.Enqueue(&NotifyEmail{Emails: []string{"test@test.com"}})
+	assert.Nil(t, err)
+	metrics.RegisterSpool(spool)
+
+	quota, _ := newTestQuota(t)
+	quota.Add(testServiceApiKey, 0, 4)
+	metrics.RegisterQuota(quota)
+
+	body := scrapeMetrics(t, metrics)
+	assert.Contains(t, body, "smtp_proxy_spool_depth 1\n")
+	assert.Contains(t, body, `smtp_proxy_daily_quota_count{api_key="gcntfy-grafana-11111111-1111-4111-8111-111111111111"} 4`)
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var metrics *Metrics
+	metrics.Connection()
+	metrics.Auth(true)
+	metrics.Message(nil)
+	metrics.Recipients(1)
+	metrics.AttachmentBytes(1)
+	metrics.NotifyRequest(201, time.Second)
+	metrics.NotifyRetry()
+	metrics.RegisterSpool(nil)
+	metrics.RegisterQuota(nil)
+}
+
+func TestIsAccepted(t *testing.T) {
+	assert.True(t, isAccepted(nil))
+	assert.True(t, isAccepted(&smtp.SMTPError{Code: 250}))
+	assert.False(t, isAccepted(&smtp.SMTPError{Code: 451}))
+	assert.False(t, isAccepted(errors.New("not authenticated")))
+}
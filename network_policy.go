@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reply sent to clients outside the allowed networks instead of the greeting
+const rejectedBanner = "554 5.7.1 Connections from your network are not accepted\r\n"
+
+// NetworkPolicy decides which client networks can connect. The deny list wins over
+// the allow list, and an empty allow list allows every network that isn't denied.
+type NetworkPolicy struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// parseCidrs reads a comma separated list of CIDRs, a single IP is read as a /32 or /128
+func parseCidrs(value string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %s", cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether a client at the address can connect
+func (p *NetworkPolicy) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(p.Deny, addr) {
+		return false
+	}
+	return len(p.Allow) == 0 || containsAddr(p.Allow, addr)
+}
+
+// remoteAddr returns the IP address of a network address such as 10.0.0.1:25
+func remoteAddr(addr net.Addr) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// filteredListener drops connections from networks the policy doesn't allow before
+// the SMTP server sees them, and counts the ones it lets through
+type filteredListener struct {
+	net.Listener
+	policy  *NetworkPolicy
+	metrics *Metrics
+}
+
+func newFilteredListener(listener net.Listener, policy *NetworkPolicy, metrics *Metrics) net.Listener {
+	return &filteredListener{Listener: listener, policy: policy, metrics: metrics}
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr, ok := remoteAddr(conn.RemoteAddr()); ok && l.policy.Allowed(addr) {
+			l.metrics.Connection()
+			return conn, nil
+		}
+
+		log.Warn().Str("event", "connection_rejected").Str("remote_addr", conn.RemoteAddr().String()).Msgf("Rejected connection from %s", conn.RemoteAddr())
+
+		// Reply in the background so a slow client can't hold up the accept loop
+		go rejectConnection(conn)
+	}
+}
+
+func rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte(rejectedBanner))
+}
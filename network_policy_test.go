@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCidrs(t *testing.T) {
+	prefixes, err := parseCidrs("10.0.0.0/8, 192.168.1.7,2001:db8::/32,,10.1.2.3/16")
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.1.0.0/16"),
+	}, prefixes)
+
+	_, err = parseCidrs("10.0.0.0/33")
+	assert.Equal(t, "invalid CIDR 10.0.0.0/33", err.Error())
+
+	_, err = parseCidrs("vpc")
+	assert.Equal(t, "invalid CIDR vpc", err.Error())
+}
+
+func TestNetworkPolicy_Allowed(t *testing.T) {
+	// Everything is allowed by default
+	policy := &NetworkPolicy{}
+	assert.True(t, policy.Allowed(netip.MustParseAddr("203.0.113.10")))
+
+	policy = &NetworkPolicy{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.66.0.0/16")},
+	}
+	assert.True(t, policy.Allowed(netip.MustParseAddr("10.1.2.3")))
+	assert.True(t, policy.Allowed(netip.MustParseAddr("::ffff:10.1.2.3")))
+	assert.True(t, policy.Allowed(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, policy.Allowed(netip.MustParseAddr("10.66.1.1")))
+	assert.False(t, policy.Allowed(netip.MustParseAddr("203.0.113.10")))
+}
+
+func newTestFilteredListener(t *testing.T, policy *NetworkPolicy, metrics *Metrics) (net.Listener, chan net.Conn) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener := newFilteredListener(inner, policy, metrics)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	return listener, accepted
+}
+
+func TestFilteredListener_Rejects(t *testing.T) {
+	metrics := newMetrics()
+	listener, accepted := newTestFilteredListener(t, &NetworkPolicy{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}, metrics)
+	defer listener.Close()
+
+	// A denied client gets the banner and is disconnected
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, rejectedBanner, line)
+	assert.Empty(t, accepted)
+
+	// Rejected connections aren't counted
+	assert.Contains(t, scrapeMetrics(t, metrics), "smtp_proxy_connections_total 0\n")
+}
+
+func TestFilteredListener_Accepts(t *testing.T) {
+	metrics := newMetrics()
+	listener, accepted := newTestFilteredListener(t, &NetworkPolicy{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}}, metrics)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	server := <-accepted
+	assert.Equal(t, conn.LocalAddr().String(), server.RemoteAddr().String())
+	server.Close()
+
+	assert.Contains(t, scrapeMetrics(t, metrics), "smtp_proxy_connections_total 1\n")
+}
@@ -2,14 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Attachment struct {
@@ -19,22 +29,190 @@ type Attachment struct {
 }
 
 type Body struct {
-	Subject string `json:"subject"`
-	Body    string `json:"body"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Fields  map[string]string `json:"fields,omitempty"`
 }
 
 type NotifyClient struct {
 	ApiKey   string
 	Client   *http.Client
 	Hostname string
+	Retry    RetryPolicy
+
+	// Number of recipients of a single email that are sent in parallel
+	Concurrency int
+
+	// Limits the number of requests in flight across all sessions
+	Slots chan struct{}
+
+	// Counts the notifications sent with each API key against the daily limit
+	Quota      *Quota
+	DailyQuota int
+
+	Metrics *Metrics
+}
+
+type NotifyError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Message    string
+}
+
+// NotifyErrorResponse is the body Notify returns with a failed request
+type NotifyErrorResponse struct {
+	Errors []struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	StatusCode int `json:"status_code"`
+}
+
+func (e *NotifyError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed if it is retried later
+func (e *NotifyError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
 }
 
 type NotifyEmail struct {
-	Attachments     []Attachment `json:"-"`
-	Emails          []string     `json:"-"`
-	EmailAddress    string       `json:"email_address"`
-	Personalisation Body         `json:"personalisation"`
-	TemplateId      string       `json:"template_id"`
+	Attachments     []Attachment      `json:"-"`
+	Emails          []string          `json:"-"`
+	EmailAddress    string            `json:"email_address"`
+	Personalisation Body              `json:"personalisation"`
+	Results         []RecipientResult `json:"-"`
+	Tenant          string            `json:"-"`
+	TemplateId      string            `json:"template_id"`
+
+	// Ties the requests to Notify to the SMTP session that sent the email
+	RequestId string          `json:"-"`
+	Logger    *zerolog.Logger `json:"-"`
+	Context   context.Context `json:"-"`
+}
+
+func (email *NotifyEmail) logger() *zerolog.Logger {
+	if email.Logger == nil {
+		return &log.Logger
+	}
+	return email.Logger
+}
+
+// context returns the context of the span the requests to Notify are children of
+func (email *NotifyEmail) context() context.Context {
+	if email.Context == nil {
+		return context.Background()
+	}
+	return email.Context
+}
+
+// RecipientResult is the outcome of sending an email to one of its recipients
+type RecipientResult struct {
+	EmailAddress string `json:"email_address"`
+	Sent         bool   `json:"sent"`
+	NotifyId     string `json:"notify_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Permanent    bool   `json:"permanent,omitempty"`
+	err          error
+}
+
+// DeliveryError lists the recipients an email could not be sent to
+type DeliveryError struct {
+	Failed []RecipientResult
+	Sent   int
+	Total  int
+}
+
+func (e *DeliveryError) Error() string {
+	failures := []string{}
+	for _, result := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%s: %s", result.EmailAddress, result.Error))
+	}
+	return fmt.Sprintf("failed to send to %d of %d recipients: %s", len(e.Failed), e.Total, strings.Join(failures, "; "))
+}
+
+// Temporary reports whether any of the failed recipients may succeed if retried
+func (e *DeliveryError) Temporary() bool {
+	for _, result := range e.Failed {
+		if !result.Permanent {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors of the recipients that failed in this attempt
+func (e *DeliveryError) Unwrap() []error {
+	errs := []error{}
+	for _, result := range e.Failed {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	return errs
+}
+
+// cause picks the error used to reply to the client, preferring a temporary
+// failure so the client knows it is worth retrying
+func (e *DeliveryError) cause() error {
+	var cause error
+	for _, result := range e.Failed {
+		if result.err == nil {
+			continue
+		}
+		if !result.Permanent {
+			return result.err
+		}
+		if cause == nil {
+			cause = result.err
+		}
+	}
+	return cause
+}
+
+func isTemporary(err error) bool {
+	var notifyErr *NotifyError
+	if errors.As(err, &notifyErr) {
+		return notifyErr.Temporary()
+	}
+
+	// Network errors and timeouts are worth retrying
+	return true
+}
+
+// newSharedNotifyClient returns the long-lived client used for every message
+func newSharedNotifyClient(config *Config) (*NotifyClient, error) {
+	httpClient, err := newHttpClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newNotifyClient(config.Notify.ApiKey, config.Notify.Hostname)
+	client.Client = httpClient
+	client.Retry = config.retryPolicy()
+	client.Concurrency = config.Delivery.Concurrency
+	client.Slots = make(chan struct{}, config.Delivery.MaxConcurrency)
+	client.DailyQuota = config.Quota.DailyLimit
+
+	return client, nil
+}
+
+// forTenant returns a client that sends as the tenant's Notify service over the same connections
+func (client *NotifyClient) forTenant(tenant *Tenant) *NotifyClient {
+	tenantClient := *client
+	tenantClient.ApiKey = tenant.ApiKey
+	tenantClient.Hostname = tenant.Hostname
+	if tenant.Limits.DailyQuota > 0 {
+		tenantClient.DailyQuota = tenant.Limits.DailyQuota
+	}
+	return &tenantClient
 }
 
 func newNotifyClient(apiKey string, hostname string) *NotifyClient {
@@ -47,8 +225,6 @@ func newNotifyClient(apiKey string, hostname string) *NotifyClient {
 
 func sendEmail(client *NotifyClient, email *NotifyEmail) error {
 
-	method := "POST"
-	contentType := "application/json"
 	resource := fmt.Sprintf("%s/v2/notifications/email", strings.Trim(client.Hostname, "/"))
 
 	// Convert the struct to a map so we can join the attachments to the personalisation
@@ -61,6 +237,11 @@ func sendEmail(client *NotifyClient, email *NotifyEmail) error {
 		return fmt.Errorf("failed to convert personalisation to map[string]interface{}")
 	}
 
+	// Extra fields are added first so they can't replace the subject, body or attachments
+	for key, value := range email.Personalisation.Fields {
+		personalisation[key] = value
+	}
+
 	personalisation["subject"] = email.Personalisation.Subject
 	personalisation["body"] = email.Personalisation.Body
 
@@ -73,47 +254,288 @@ func sendEmail(client *NotifyClient, email *NotifyEmail) error {
 		}
 	}
 
-	for _, email_address := range email.Emails {
+	// Keep a result for every recipient so a retry only sends to the ones that failed
+	for len(email.Results) < len(email.Emails) {
+		email.Results = append(email.Results, RecipientResult{EmailAddress: email.Emails[len(email.Results)]})
+	}
+
+	// Build the request for every recipient that still needs the email
+	requests := []recipientRequest{}
+	for i, email_address := range email.Emails {
+		result := &email.Results[i]
+		if result.Sent || result.Permanent {
+			continue
+		}
 
 		emailPayload["email_address"] = email_address
 
 		body, err := json.Marshal(emailPayload)
-
-		log.Info().Msgf("Sending email to : %s", email_address)
 		if err != nil {
 			return err
 		}
 
-		req, err := http.NewRequest(method, resource, bytes.NewBuffer(body))
-		if err != nil {
-			return err
+		requests = append(requests, recipientRequest{body: body, result: result, requestId: email.RequestId, logger: email.logger(), ctx: email.context()})
+	}
+
+	concurrency := client.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(requests) {
+		concurrency = len(requests)
+	}
+
+	// Each worker only writes to the result of the request it is handling
+	queue := make(chan recipientRequest)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for request := range queue {
+				client.sendToRecipient(resource, request)
+			}
+		}()
+	}
+
+	for _, request := range requests {
+		queue <- request
+	}
+	close(queue)
+	wg.Wait()
+
+	deliveryErr := &DeliveryError{Total: len(email.Results)}
+	for _, result := range email.Results {
+		if result.Sent {
+			deliveryErr.Sent++
+		} else {
+			deliveryErr.Failed = append(deliveryErr.Failed, result)
 		}
+	}
+
+	if len(deliveryErr.Failed) > 0 {
+		return deliveryErr
+	}
+
+	return nil
+}
 
-		req.Header.Set("Content-Type", contentType)
-		req.Header.Set("Authorization", fmt.Sprintf("ApiKey-v1 %s", client.ApiKey))
+type recipientRequest struct {
+	body      []byte
+	result    *RecipientResult
+	requestId string
+	logger    *zerolog.Logger
+	ctx       context.Context
+}
 
-		resp, err := client.Client.Do(req)
+func (client *NotifyClient) sendToRecipient(resource string, request recipientRequest) {
+	result := request.result
 
-		if err != nil {
-			log.Error().Msgf("Error sending email: %s", err)
-			return err
+	// The daily quota is checked again here since spooled mail is sent long after the
+	// session that accepted it
+	if !client.Quota.Reserve(client.ApiKey, client.DailyQuota, 1) {
+		request.logger.Warn().Str("event", "quota_exceeded").Str("api_key", apiKeyName(client.ApiKey)).Msgf("Not sending email to %s over the daily quota", redactAddress(result.EmailAddress))
+		result.Error = errQuotaReached.Error()
+		result.Permanent = false
+		result.err = errQuotaReached
+		return
+	}
+
+	request.logger.Info().Msgf("Sending email to : %s", redactAddress(result.EmailAddress))
+	id, err := client.postWithRetry(resource, request)
+	if err != nil {
+		client.Quota.Release(client.ApiKey, client.DailyQuota, 1)
+		request.logger.Error().Msgf("Error sending email to %s: %s", redactAddress(result.EmailAddress), err)
+		result.Error = err.Error()
+		result.Permanent = !isTemporary(err)
+		result.err = err
+		return
+	}
+
+	request.logger.Info().Msgf("Sent email to %s with notification ID %s", redactAddress(result.EmailAddress), id)
+	result.Sent = true
+	result.NotifyId = id
+	result.Error = ""
+	result.err = nil
+}
+
+// acquire waits for a free slot in the limit shared by every session and
+// returns the function that releases it
+func (client *NotifyClient) acquire() func() {
+	if client.Slots == nil {
+		return func() {}
+	}
+
+	client.Slots <- struct{}{}
+	return func() { <-client.Slots }
+}
+
+// postWithRetry retries temporary failures using exponential backoff with jitter,
+// unless Notify tells us how long to wait with a Retry-After header
+func (client *NotifyClient) postWithRetry(resource string, request recipientRequest) (string, error) {
+	maxAttempts := client.Retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		release := client.acquire()
+		id, err := client.post(resource, request)
+		release()
+		if err == nil {
+			return id, nil
 		}
 
-		defer resp.Body.Close()
+		var notifyErr *NotifyError
+		isNotifyErr := errors.As(err, &notifyErr)
 
-		if resp.StatusCode != 201 {
-			log.Error().Msgf("Unexpected status code: %d", resp.StatusCode)
-			respbody, err := io.ReadAll(resp.Body)
+		// Validation and authentication errors will never succeed so fail straight away
+		if isNotifyErr && !notifyErr.Temporary() {
+			return "", err
+		}
 
-			if err != nil {
-				log.Error().Msgf("Error reading response body: %s", err)
-				return err
+		if attempt >= maxAttempts {
+			return "", err
+		}
+
+		delay := client.Retry.backoff(attempt)
+		if isNotifyErr && notifyErr.RetryAfter > 0 {
+			if client.Retry.MaxBackoff > 0 && notifyErr.RetryAfter > client.Retry.MaxBackoff {
+				request.logger.Warn().Msgf("Retry-After of %s is longer than the maximum backoff, giving up", notifyErr.RetryAfter)
+				return "", err
 			}
-			log.Error().Msgf("Response: %s", respbody)
+			delay = notifyErr.RetryAfter
+		}
+
+		request.logger.Warn().Msgf("Retrying in %s (attempt %d of %d): %s", delay, attempt+1, maxAttempts, err)
+		client.Metrics.NotifyRetry()
+		time.Sleep(delay)
+	}
+}
+
+// post sends a single request to Notify and returns the ID of the notification
+func (client *NotifyClient) post(resource string, request recipientRequest) (id string, err error) {
+	method := "POST"
+	contentType := "application/json"
+
+	ctx, span := tracer().Start(request.ctx, "notify.post",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(method),
+			semconv.URLFull(resource),
+		),
+	)
+	defer func() { endSpan(span, err) }()
 
-			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	req, err := http.NewRequestWithContext(ctx, method, resource, bytes.NewBuffer(request.body))
+	if err != nil {
+		return "", err
+	}
+
+	// Pass the trace on to Notify
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", fmt.Sprintf("ApiKey-v1 %s", client.ApiKey))
+	if request.requestId != "" {
+		req.Header.Set("X-Request-Id", request.requestId)
+	}
+
+	start := time.Now()
+	resp, err := client.Client.Do(req)
+
+	if err != nil {
+		client.Metrics.NotifyRequest(0, time.Since(start))
+		request.logger.Error().Msgf("Error sending email: %s", err)
+		return "", err
+	}
+	client.Metrics.NotifyRequest(resp.StatusCode, time.Since(start))
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		request.logger.Error().Msgf("Unexpected status code: %d", resp.StatusCode)
+		respbody, err := io.ReadAll(resp.Body)
+
+		if err != nil {
+			request.logger.Error().Msgf("Error reading response body: %s", err)
+			return "", err
+		}
+		request.logger.Error().Msgf("Response: %s", redactText(string(respbody)))
+
+		return "", &NotifyError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Message:    parseErrorMessage(respbody),
 		}
 	}
 
-	return nil
+	// The notification ID is only used for logging so a body we can't decode is not an error
+	var notification struct {
+		Id string `json:"id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&notification)
+
+	return notification.Id, nil
+}
+
+// parseErrorMessage joins the messages from a Notify error response
+func parseErrorMessage(body []byte) string {
+	var response NotifyErrorResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return ""
+	}
+
+	messages := []string{}
+	for _, e := range response.Errors {
+		if e.Message != "" {
+			messages = append(messages, e.Message)
+		} else if e.Error != "" {
+			messages = append(messages, e.Error)
+		}
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// backoff returns the delay before the next attempt. The delay doubles on every
+// attempt and half of it is randomized so that clients do not retry in lockstep.
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if policy.MaxBackoff > 0 && delay >= policy.MaxBackoff {
+			delay = policy.MaxBackoff
+			break
+		}
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter supports both the delay-seconds and HTTP-date forms of the header
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -79,3 +85,303 @@ func TestSendEmail(t *testing.T) {
 	// Verify the result
 	assert.Nil(t, err)
 }
+
+func TestSendEmail_RetriesTemporaryErrors(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Retry = RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"test@example.com"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, requests)
+}
+
+func TestSendEmail_GivesUpAfterMaxAttempts(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Retry = RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"test@example.com"}})
+
+	assert.Equal(t, "failed to send to 1 of 1 recipients: test@example.com: unexpected status code: 503", err.Error())
+	assert.Equal(t, 2, requests)
+}
+
+func TestSendEmail_DoesNotRetryValidationErrors(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Retry = RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}
+
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"test@example.com"}})
+
+	assert.Equal(t, "failed to send to 1 of 1 recipients: test@example.com: unexpected status code: 400", err.Error())
+	assert.Equal(t, 1, requests)
+}
+
+func TestSendEmail_ReleasesQuotaOfFailedSends(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("fail@example.com")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	quota, _ := newTestQuota(t)
+	client := newNotifyClient(testServiceApiKey, mockServer.URL)
+	client.Quota = quota
+	client.DailyQuota = 5
+
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"test@example.com", "fail@example.com"}})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, quota.Count(testServiceApiKey))
+}
+
+func TestSendEmail_HonoursRetryAfter(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Retry = RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	// Waiting a minute is longer than the maximum backoff so the request is not retried
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"test@example.com"}})
+
+	assert.Equal(t, "failed to send to 1 of 1 recipients: test@example.com: unexpected status code: 429", err.Error())
+	assert.Equal(t, 1, requests)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("invalid"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1"))
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, delay > 50*time.Second && delay <= time.Minute)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		delay := policy.backoff(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d: %s", attempt, delay)
+	}
+}
+
+func TestSendEmail_ReturnsNotifyErrorMessage(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, err := w.Write([]byte(`{"errors": [{"error": "ValidationError", "message": "email_address Not a valid email address"}], "status_code": 400}`))
+		assert.Nil(t, err)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+
+	err := sendEmail(client, &NotifyEmail{Emails: []string{"not-an-email"}})
+
+	var notifyErr *NotifyError
+	assert.True(t, errors.As(err, &notifyErr))
+	assert.Equal(t, 400, notifyErr.StatusCode)
+	assert.Equal(t, "email_address Not a valid email address", notifyErr.Message)
+}
+
+func TestSendEmail_ContinuesAfterFailedRecipient(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+
+		if payload["email_address"] == "invalid@example.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"id": "notification-id"}`))
+		assert.Nil(t, err)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	email := &NotifyEmail{Emails: []string{"invalid@example.com", "test@example.com"}}
+
+	err := sendEmail(client, email)
+
+	var deliveryErr *DeliveryError
+	assert.True(t, errors.As(err, &deliveryErr))
+	assert.Equal(t, 1, deliveryErr.Sent)
+	assert.Equal(t, 2, deliveryErr.Total)
+	assert.False(t, deliveryErr.Temporary())
+	assert.Equal(t, "invalid@example.com", deliveryErr.Failed[0].EmailAddress)
+
+	assert.False(t, email.Results[0].Sent)
+	assert.True(t, email.Results[0].Permanent)
+	assert.True(t, email.Results[1].Sent)
+	assert.Equal(t, "notification-id", email.Results[1].NotifyId)
+}
+
+func TestSendEmail_SendsRecipientsInParallel(t *testing.T) {
+	var inFlight, maxInFlight int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Concurrency = 3
+
+	email := &NotifyEmail{}
+	for i := 0; i < 6; i++ {
+		email.Emails = append(email.Emails, fmt.Sprintf("test%d@example.com", i))
+	}
+
+	err := sendEmail(client, email)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), maxInFlight)
+	for i, result := range email.Results {
+		assert.Equal(t, email.Emails[i], result.EmailAddress)
+		assert.True(t, result.Sent)
+	}
+}
+
+func TestSendEmail_RespectsSharedSlots(t *testing.T) {
+	var inFlight, maxInFlight int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	// Two sessions sharing a single slot can only send one request at a time
+	slots := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for session := 0; session < 2; session++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newNotifyClient("test-api-key", mockServer.URL)
+			client.Concurrency = 3
+			client.Slots = slots
+			err := sendEmail(client, &NotifyEmail{Emails: []string{"test0@example.com", "test1@example.com", "test2@example.com"}})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxInFlight)
+}
+
+func TestSendEmail_PersonalisationFields(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requestPayload))
+
+		personalisation := requestPayload["personalisation"].(map[string]interface{})
+		assert.Equal(t, "1234", personalisation["case_number"])
+		assert.Equal(t, "Jane", personalisation["name"])
+
+		// Fields can't replace the subject or body
+		assert.Equal(t, "Test Subject", personalisation["subject"])
+		assert.Equal(t, "Test Body", personalisation["body"])
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	email := &NotifyEmail{
+		Emails: []string{"test@example.com"},
+		Personalisation: Body{
+			Subject: "Test Subject",
+			Body:    "Test Body",
+			Fields: map[string]string{
+				"case_number": "1234",
+				"name":        "Jane",
+				"subject":     "Replaced",
+				"body":        "Replaced",
+			},
+		},
+	}
+
+	err := sendEmail(client, email)
+
+	assert.Nil(t, err)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Argon2id parameters used by hash-password, the second recommended option of RFC 9106
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// SCRAM-SHA-256 parameters used by hash-password, the minimum iterations of RFC 7677
+const (
+	scramIterations = 4096
+	scramSaltLen    = 16
+)
+
+var errPlaintextPassword = errors.New("password must be a bcrypt, argon2id or SCRAM-SHA-256 hash unless plaintext passwords are allowed")
+
+// argon2Hash is a hash in the PHC string format, $argon2id$v=19$m=65536,t=3,p=4$salt$key
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// scramCredentials are the keys stored for SCRAM-SHA-256 in the format of RFC 5803,
+// SCRAM-SHA-256$4096:salt$StoredKey:ServerKey
+type scramCredentials struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func isArgon2Hash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func isScramHash(hash string) bool {
+	return strings.HasPrefix(hash, "SCRAM-SHA-256$")
+}
+
+func isPasswordHash(password string) bool {
+	return isBcryptHash(password) || isArgon2Hash(password) || isScramHash(password)
+}
+
+// hashPassword returns an argon2id hash of the password
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		argon2Memory,
+		argon2Time,
+		argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// hashPasswordBcrypt returns a bcrypt hash of the password
+func hashPasswordBcrypt(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// hashPasswordScram returns the SCRAM-SHA-256 credentials of the password, which
+// also work with the PLAIN and LOGIN mechanisms
+func hashPasswordScram(password string) (string, error) {
+	salt := make([]byte, scramSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	credentials := newScramCredentials(password, salt, scramIterations)
+
+	return fmt.Sprintf(
+		"SCRAM-SHA-256$%d:%s$%s:%s",
+		credentials.iterations,
+		base64.StdEncoding.EncodeToString(credentials.salt),
+		base64.StdEncoding.EncodeToString(credentials.storedKey),
+		base64.StdEncoding.EncodeToString(credentials.serverKey),
+	), nil
+}
+
+func newScramCredentials(password string, salt []byte, iterations int) *scramCredentials {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSha256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &scramCredentials{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSha256(saltedPassword, "Server Key"),
+	}
+}
+
+func parseScramHash(hash string) (*scramCredentials, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != "SCRAM-SHA-256" {
+		return nil, errors.New("invalid SCRAM-SHA-256 hash")
+	}
+
+	c := &scramCredentials{}
+	params := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(params) != 2 || len(keys) != 2 {
+		return nil, errors.New("invalid SCRAM-SHA-256 hash")
+	}
+
+	if _, err := fmt.Sscanf(params[0], "%d", &c.iterations); err != nil || c.iterations < scramIterations {
+		return nil, fmt.Errorf("SCRAM-SHA-256 iterations must be at least %d", scramIterations)
+	}
+
+	var err error
+	if c.salt, err = base64.StdEncoding.DecodeString(params[1]); err != nil || len(c.salt) == 0 {
+		return nil, errors.New("invalid SCRAM-SHA-256 salt")
+	}
+	if c.storedKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(c.storedKey) != sha256.Size {
+		return nil, errors.New("invalid SCRAM-SHA-256 stored key")
+	}
+	if c.serverKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(c.serverKey) != sha256.Size {
+		return nil, errors.New("invalid SCRAM-SHA-256 server key")
+	}
+
+	return c, nil
+}
+
+func hmacSha256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2id version")
+	}
+
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil || h.time == 0 || h.threads == 0 {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+
+	return h, nil
+}
+
+// validatePassword checks that a configured password is a hash that can be verified,
+// or a long enough plaintext password when those are allowed
+func validatePassword(password string, allowPlaintext bool) error {
+	switch {
+	case isBcryptHash(password):
+		if _, err := bcrypt.Cost([]byte(password)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash: %s", err)
+		}
+	case isArgon2Hash(password):
+		if _, err := parseArgon2Hash(password); err != nil {
+			return err
+		}
+	case isScramHash(password):
+		if _, err := parseScramHash(password); err != nil {
+			return err
+		}
+	case !allowPlaintext:
+		return errPlaintextPassword
+	case len(password) < 14:
+		return errors.New("password must be at least fourteen characters")
+	}
+	return nil
+}
+
+// verifyPassword compares a password with the configured hash, or plaintext password
+// when those are allowed, in constant time
+func verifyPassword(hash string, password string, allowPlaintext bool) bool {
+	switch {
+	case hash == "":
+		return false
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case isArgon2Hash(hash):
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	case isScramHash(hash):
+		c, err := parseScramHash(hash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(newScramCredentials(password, c.salt, c.iterations).storedKey, c.storedKey) == 1
+	case allowPlaintext:
+		// Compare digests so the time taken doesn't depend on the password length
+		expected := sha256.Sum256([]byte(hash))
+		actual := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("longpasswordgo")
+	assert.Nil(t, err)
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=65536,t=3,p=4\$[A-Za-z0-9+/]+\$[A-Za-z0-9+/]+$`, hash)
+	assert.Nil(t, validatePassword(hash, false))
+
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+	assert.False(t, verifyPassword(hash, "longpasswordgo1", false))
+
+	// The same password hashes differently every time
+	other, err := hashPassword("longpasswordgo")
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, other)
+}
+
+func TestHashPasswordBcrypt(t *testing.T) {
+	hash, err := hashPasswordBcrypt("longpasswordgo")
+	assert.Nil(t, err)
+	assert.Nil(t, validatePassword(hash, false))
+
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+	assert.False(t, verifyPassword(hash, "longpasswordgo1", false))
+}
+
+func TestVerifyPassword_Plaintext(t *testing.T) {
+	assert.True(t, verifyPassword("longpasswordgo", "longpasswordgo", true))
+	assert.False(t, verifyPassword("longpasswordgo", "longpasswordg", true))
+
+	// Plaintext passwords are rejected unless they are allowed
+	assert.False(t, verifyPassword("longpasswordgo", "longpasswordgo", false))
+}
+
+func TestValidatePassword(t *testing.T) {
+	assert.Equal(t, errPlaintextPassword, validatePassword("longpasswordgo", false))
+	assert.Nil(t, validatePassword("longpasswordgo", true))
+	assert.Equal(t, "password must be at least fourteen characters", validatePassword("short", true).Error())
+
+	assert.Equal(t, "invalid argon2id hash", validatePassword("$argon2id$v=19$m=65536,t=3,p=4$c2FsdA", false).Error())
+	assert.Equal(t, "unsupported argon2id version", validatePassword("$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$a2V5", false).Error())
+	assert.Equal(t, "invalid argon2id parameters", validatePassword("$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5", false).Error())
+	assert.Equal(t, "invalid argon2id salt", validatePassword("$argon2id$v=19$m=65536,t=3,p=4$!$a2V5", false).Error())
+	assert.NotNil(t, validatePassword("$2a$10$invalid", false))
+
+	// A malformed hash never verifies
+	assert.False(t, verifyPassword("$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5", "longpasswordgo", true))
+}
+
+func TestHashPasswordScram(t *testing.T) {
+	hash, err := hashPasswordScram("longpasswordgo")
+	assert.Nil(t, err)
+	assert.Regexp(t, `^SCRAM-SHA-256\$4096:[A-Za-z0-9+/=]+\$[A-Za-z0-9+/=]+:[A-Za-z0-9+/=]+$`, hash)
+	assert.Nil(t, validatePassword(hash, false))
+
+	assert.True(t, verifyPassword(hash, "longpasswordgo", false))
+	assert.False(t, verifyPassword(hash, "longpasswordgo1", false))
+
+	assert.Equal(t, "SCRAM-SHA-256 iterations must be at least 4096", validatePassword("SCRAM-SHA-256$1000:c2FsdA==$a2V5:a2V5", false).Error())
+	assert.Equal(t, "invalid SCRAM-SHA-256 stored key", validatePassword("SCRAM-SHA-256$4096:c2FsdA==$a2V5:a2V5", false).Error())
+}
+
+func TestNewScramCredentials(t *testing.T) {
+	// Example exchange from RFC 7677
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	assert.Nil(t, err)
+	credentials := newScramCredentials("pencil", salt, 4096)
+	assert.True(t, verifyPassword(fmt.Sprintf(
+		"SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$%s:%s",
+		base64.StdEncoding.EncodeToString(credentials.storedKey),
+		base64.StdEncoding.EncodeToString(credentials.serverKey),
+	), "pencil", false))
+
+	clientFinal, serverFinal := scramClientFinal(
+		"pencil",
+		"n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", clientFinal)
+	assert.Equal(t, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", serverFinal)
+}
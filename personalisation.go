@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Prefix of the headers that set extra personalisation fields
+const personalisationHeaderPrefix = "X-Notify-Personalisation-"
+
+// Prefix of every header used to control the proxy
+const controlHeaderPrefix = "X-Notify-"
+
+// Ways to turn the rest of a personalisation header name into a key
+const (
+	keyTransformSnake = "snake"
+	keyTransformLower = "lower"
+	keyTransformNone  = "none"
+)
+
+func isValidKeyTransform(transform string) bool {
+	return transform == keyTransformSnake || transform == keyTransformLower || transform == keyTransformNone
+}
+
+// extractPersonalisation turns headers like X-Notify-Personalisation-Case-Number into
+// personalisation fields like case_number
+func extractPersonalisation(header mail.Header, transform string) map[string]string {
+	fields := map[string]string{}
+	for name, values := range header {
+		if len(values) == 0 || len(name) <= len(personalisationHeaderPrefix) || !strings.EqualFold(name[:len(personalisationHeaderPrefix)], personalisationHeaderPrefix) {
+			continue
+		}
+
+		key := name[len(personalisationHeaderPrefix):]
+		switch transform {
+		case keyTransformSnake:
+			key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+		case keyTransformLower:
+			key = strings.ToLower(key)
+		}
+
+		fields[key] = strings.TrimSpace(values[0])
+	}
+	return fields
+}
+
+// stripControlHeaders removes the X-Notify-* headers so they never reach the rendered content
+func stripControlHeaders(header mail.Header) {
+	for name := range header {
+		if len(name) >= len(controlHeaderPrefix) && strings.EqualFold(name[:len(controlHeaderPrefix)], controlHeaderPrefix) {
+			delete(header, name)
+		}
+	}
+}
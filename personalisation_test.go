@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractPersonalisation(t *testing.T) {
+	header := mail.Header{
+		"X-Notify-Personalisation-Case-Number": []string{" 1234 "},
+		"X-Notify-Personalisation-Name":        []string{"Jane", "Ignored"},
+		"X-Notify-Template-Id":                 []string{"00000000-0000-4000-8000-000000000000"},
+		"X-Notify-Personalisation-":            []string{"empty key"},
+		"Subject":                              []string{"Test"},
+	}
+
+	assert.Equal(t, map[string]string{"case_number": "1234", "name": "Jane"}, extractPersonalisation(header, keyTransformSnake))
+	assert.Equal(t, map[string]string{"case-number": "1234", "name": "Jane"}, extractPersonalisation(header, keyTransformLower))
+	assert.Equal(t, map[string]string{"Case-Number": "1234", "Name": "Jane"}, extractPersonalisation(header, keyTransformNone))
+}
+
+func TestStripControlHeaders(t *testing.T) {
+	header := mail.Header{
+		"X-Notify-Personalisation-Case-Number": []string{"1234"},
+		"X-Notify-Template-Id":                 []string{"00000000-0000-4000-8000-000000000000"},
+		"X-Mailer":                             []string{"Test"},
+		"Subject":                              []string{"Test"},
+	}
+
+	stripControlHeaders(header)
+
+	assert.Equal(t, mail.Header{"X-Mailer": []string{"Test"}, "Subject": []string{"Test"}}, header)
+}
+
+func TestIsValidKeyTransform(t *testing.T) {
+	assert.True(t, isValidKeyTransform("snake"))
+	assert.True(t, isValidKeyTransform("lower"))
+	assert.True(t, isValidKeyTransform("none"))
+	assert.False(t, isValidKeyTransform("camel"))
+}
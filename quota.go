@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Quota counts the notifications sent with each Notify API key per UTC day, so the
+// proxy can warn before a service reaches its daily limit and stop at it
+type Quota struct {
+	// File the counts are saved to, they are only kept in memory when empty
+	Path string
+
+	// Percentages of the daily limit that log a warning
+	Thresholds []int
+
+	mu    sync.Mutex
+	state QuotaState
+	now   func() time.Time
+}
+
+// QuotaState is the count of each API key on a day
+type QuotaState struct {
+	Day    string         `json:"day"`
+	Counts map[string]int `json:"counts"`
+
+	// Highest threshold each API key has been warned about
+	Warned map[string]int `json:"warned,omitempty"`
+}
+
+func newQuota(path string, thresholds []int) (*Quota, error) {
+	q := &Quota{
+		Path:       path,
+		Thresholds: thresholds,
+		now:        time.Now,
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads today's counts back from the state file
+func (q *Quota) load() error {
+	q.state = QuotaState{Day: q.today(), Counts: map[string]int{}, Warned: map[string]int{}}
+
+	if q.Path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(q.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state QuotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("quota state %s: %s", q.Path, err)
+	}
+
+	// Counts from an earlier day no longer matter
+	if state.Day == q.state.Day {
+		if state.Counts != nil {
+			q.state.Counts = state.Counts
+		}
+		if state.Warned != nil {
+			q.state.Warned = state.Warned
+		}
+	}
+	return nil
+}
+
+// parseThresholds reads a comma separated list of percentages such as 80,90
+func parseThresholds(value string) ([]int, error) {
+	thresholds := []int{}
+	for _, entry := range parseList(value) {
+		threshold, err := strconv.Atoi(strings.TrimSuffix(entry, "%"))
+		if err != nil || threshold < 1 || threshold > 99 {
+			return nil, fmt.Errorf("invalid quota warning threshold %s, use a percentage between 1 and 99", entry)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// apiKeyName identifies an API key without its secret. Notify API keys end with the
+// secret, and the rest is the key name and service ID.
+func apiKeyName(apiKey string) string {
+	if secret := len(apiKey) - 37; secret > len("gcntfy-") && apiKey[secret] == '-' {
+		return apiKey[:secret]
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func (q *Quota) today() string {
+	return q.now().UTC().Format(time.DateOnly)
+}
+
+// rollover starts new counts when the UTC day changes
+func (q *Quota) rollover() {
+	if today := q.today(); q.state.Day != today {
+		q.state = QuotaState{Day: today, Counts: map[string]int{}, Warned: map[string]int{}}
+	}
+}
+
+// Count returns the notifications sent with the API key today
+func (q *Quota) Count(apiKey string) int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	return q.state.Counts[apiKeyName(apiKey)]
+}
+
+// Exceeded reports whether sending n more notifications with the API key would go
+// over the daily limit, a limit of 0 is unlimited
+func (q *Quota) Exceeded(apiKey string, limit int, n int) bool {
+	return limit > 0 && q.Count(apiKey)+n > limit
+}
+
+// Add counts n notifications sent with the API key, warns when the count passes a
+// threshold of the daily limit and saves the counts
+func (q *Quota) Add(apiKey string, limit int, n int) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	q.add(apiKeyName(apiKey), limit, n)
+}
+
+// Reserve counts n notifications about to be sent with the API key, unless they
+// would go over the daily limit. Checking and counting together means concurrent
+// sends can't both take the last notification of the day.
+func (q *Quota) Reserve(apiKey string, limit int, n int) bool {
+	if q == nil {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	name := apiKeyName(apiKey)
+	if limit > 0 && q.state.Counts[name]+n > limit {
+		return false
+	}
+	q.add(name, limit, n)
+	return true
+}
+
+// Release gives back notifications reserved on a send that failed
+func (q *Quota) Release(apiKey string, limit int, n int) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Reservations from an earlier day were dropped with its counts
+	q.rollover()
+	name := apiKeyName(apiKey)
+	if _, ok := q.state.Counts[name]; !ok {
+		return
+	}
+	q.state.Counts[name] = max(0, q.state.Counts[name]-n)
+	q.saveLimited(limit)
+}
+
+func (q *Quota) add(name string, limit int, n int) {
+	q.state.Counts[name] += n
+	if limit > 0 {
+		q.warn(name, q.state.Counts[name], limit)
+	}
+	q.saveLimited(limit)
+}
+
+// saveLimited saves the counts when the API key has a limit, counts without one are
+// only kept in memory so they aren't worth a write on every send
+func (q *Quota) saveLimited(limit int) {
+	if limit <= 0 {
+		return
+	}
+	if err := q.save(); err != nil {
+		log.Error().Msgf("Error saving quota state: %s", err)
+	}
+}
+
+// warn logs the highest threshold the count has passed, once per threshold a day
+func (q *Quota) warn(name string, count int, limit int) {
+	if count >= limit {
+		if q.state.Warned[name] < 100 {
+			q.state.Warned[name] = 100
+			log.Error().Str("event", "quota_reached").Str("api_key", name).Int("count", count).Int("limit", limit).Msgf("Daily quota of %d notifications reached for %s", limit, name)
+		}
+		return
+	}
+
+	passed := 0
+	for _, threshold := range q.Thresholds {
+		if count*100 >= threshold*limit && threshold > passed {
+			passed = threshold
+		}
+	}
+	if passed > q.state.Warned[name] {
+		q.state.Warned[name] = passed
+		log.Warn().Str("event", "quota_warning").Str("api_key", name).Int("count", count).Int("limit", limit).Msgf("Daily quota for %s is %d%% used", name, passed)
+	}
+}
+
+// State returns a copy of today's counts
+func (q *Quota) State() QuotaState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover()
+	state := QuotaState{Day: q.state.Day, Counts: map[string]int{}}
+	for name, count := range q.state.Counts {
+		state.Counts[name] = count
+	}
+	return state
+}
+
+// save writes the counts to a temporary file and renames it into place, the same
+// way the spool saves messages
+func (q *Quota) save() error {
+	if q.Path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(q.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.Path), ".tmp-quota-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), q.Path)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testServiceApiKey = "gcntfy-grafana-11111111-1111-4111-8111-111111111111-22222222-2222-4222-8222-222222222222"
+
+func newTestQuota(t *testing.T) (*Quota, *time.Time) {
+	clock, now := newTestClock(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC))
+	quota := &Quota{
+		Path:       filepath.Join(t.TempDir(), "quota.json"),
+		Thresholds: []int{50, 80},
+		now:        clock,
+	}
+	assert.Nil(t, quota.load())
+	return quota, now
+}
+
+func TestApiKeyName(t *testing.T) {
+	// The secret at the end of a Notify API key is left out
+	assert.Equal(t, "gcntfy-grafana-11111111-1111-4111-8111-111111111111", apiKeyName(testServiceApiKey))
+
+	// Other keys are hashed
+	name := apiKeyName("test-api-key")
+	assert.True(t, strings.HasPrefix(name, "sha256:"))
+	assert.NotContains(t, name, "test-api-key")
+	assert.Equal(t, name, apiKeyName("test-api-key"))
+}
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds("80, 90%,")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{80, 90}, thresholds)
+
+	_, err = parseThresholds("80,100")
+	assert.Equal(t, "invalid quota warning threshold 100, use a percentage between 1 and 99", err.Error())
+}
+
+func TestQuota_AddAndExceeded(t *testing.T) {
+	quota, _ := newTestQuota(t)
+
+	quota.Add(testServiceApiKey, 10, 4)
+	assert.Equal(t, 4, quota.Count(testServiceApiKey))
+	assert.Equal(t, 0, quota.Count("test-api-key"))
+
+	assert.False(t, quota.Exceeded(testServiceApiKey, 10, 6))
+	assert.True(t, quota.Exceeded(testServiceApiKey, 10, 7))
+
+	// A limit of 0 only counts
+	assert.False(t, quota.Exceeded(testServiceApiKey, 0, 1000))
+}
+
+func TestQuota_Warnings(t *testing.T) {
+	quota, _ := newTestQuota(t)
+	name := apiKeyName(testServiceApiKey)
+
+	quota.Add(testServiceApiKey, 10, 4)
+	assert.Equal(t, 0, quota.state.Warned[name])
+
+	quota.Add(testServiceApiKey, 10, 1)
+	assert.Equal(t, 50, quota.state.Warned[name])
+
+	// Passing several thresholds at once only warns about the highest
+	quota, _ = newTestQuota(t)
+	quota.Add(testServiceApiKey, 10, 9)
+	assert.Equal(t, 80, quota.state.Warned[name])
+
+	quota.Add(testServiceApiKey, 10, 1)
+	assert.Equal(t, 100, quota.state.Warned[name])
+}
+
+func TestQuota_Rollover(t *testing.T) {
+	quota, now := newTestQuota(t)
+	quota.Add(testServiceApiKey, 10, 10)
+	assert.True(t, quota.Exceeded(testServiceApiKey, 10, 1))
+
+	// The counts start again at midnight UTC
+	*now = now.Add(time.Hour)
+	assert.Equal(t, 0, quota.Count(testServiceApiKey))
+	assert.Equal(t, "2024-01-02", quota.State().Day)
+}
+
+func TestQuota_ReserveAndRelease(t *testing.T) {
+	quota, _ := newTestQuota(t)
+
+	assert.True(t, quota.Reserve(testServiceApiKey, 3, 2))
+	assert.False(t, quota.Reserve(testServiceApiKey, 3, 2))
+	assert.True(t, quota.Reserve(testServiceApiKey, 3, 1))
+	assert.False(t, quota.Reserve(testServiceApiKey, 3, 1))
+	assert.Equal(t, 3, quota.Count(testServiceApiKey))
+
+	// A failed send gives its notification back
+	quota.Release(testServiceApiKey, 3, 1)
+	assert.Equal(t, 2, quota.Count(testServiceApiKey))
+	assert.True(t, quota.Reserve(testServiceApiKey, 3, 1))
+
+	// A limit of 0 never refuses
+	assert.True(t, quota.Reserve("test-api-key", 0, 1000))
+
+	var none *Quota
+	assert.True(t, none.Reserve(testServiceApiKey, 3, 10))
+}
+
+func TestQuota_OnlySavesWithALimit(t *testing.T) {
+	quota, _ := newTestQuota(t)
+
+	quota.Add(testServiceApiKey, 0, 3)
+	_, err := os.Stat(quota.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	quota.Add(testServiceApiKey, 10, 1)
+	_, err = os.Stat(quota.Path)
+	assert.Nil(t, err)
+}
+
+func TestQuota_Persists(t *testing.T) {
+	quota, now := newTestQuota(t)
+	quota.Add(testServiceApiKey, 10, 3)
+
+	// The counts are read back on start for the same day
+	reloaded := &Quota{Path: quota.Path, now: quota.now}
+	assert.Nil(t, reloaded.load())
+	assert.Equal(t, 3, reloaded.Count(testServiceApiKey))
+
+	// and dropped on another day
+	*now = now.Add(24 * time.Hour)
+	assert.Nil(t, reloaded.load())
+	assert.Equal(t, 0, reloaded.Count(testServiceApiKey))
+
+	// A missing file starts from zero, a corrupt one is an error
+	_, err := newQuota(filepath.Join(t.TempDir(), "missing.json"), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(quota.Path, []byte("{"), 0600))
+	_, err = newQuota(quota.Path, nil)
+	assert.NotNil(t, err)
+}
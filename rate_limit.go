@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// What a rate limit counts
+const (
+	rateLimitMessages   = "messages"
+	rateLimitRecipients = "recipients"
+)
+
+// RateLimits are the per minute limits of one kind, 0 disables a limit
+type RateLimits struct {
+	User   int
+	Ip     int
+	Global int
+}
+
+// rateLimit is a token bucket that holds PerMinute tokens and refills at PerMinute
+// tokens a minute, a PerMinute of 0 disables it
+type rateLimit struct {
+	Key       string
+	PerMinute int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps the token buckets of the per user, per IP and global limits
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// Take takes n tokens from every limit, or none of them if any limit is short
+func (r *RateLimiter) Take(limits []rateLimit, n int) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.prune(now)
+
+	buckets := []*tokenBucket{}
+	for _, limit := range limits {
+		if limit.PerMinute <= 0 {
+			continue
+		}
+
+		bucket := r.refill(limit, now)
+		if bucket.tokens < float64(n) {
+			return false
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens -= float64(n)
+	}
+	return true
+}
+
+// Fits reports whether n tokens could ever be taken at once. A bucket never holds
+// more than a minute of tokens, so waiting for a larger n doesn't help.
+func (r *RateLimiter) Fits(limits []rateLimit, n int) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, limit := range limits {
+		if limit.PerMinute > 0 && n > limit.PerMinute {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RateLimiter) refill(limit rateLimit, now time.Time) *tokenBucket {
+	capacity := float64(limit.PerMinute)
+
+	bucket, ok := r.buckets[limit.Key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		r.buckets[limit.Key] = bucket
+	}
+
+	bucket.tokens = min(capacity, bucket.tokens+now.Sub(bucket.last).Minutes()*capacity)
+	bucket.last = now
+	return bucket
+}
+
+// prune drops the buckets that have been idle for a minute once a minute, an idle
+// bucket is full again so it's the same as a new one
+func (r *RateLimiter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.last) >= time.Minute {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter() (*RateLimiter, *time.Time) {
+	limiter := newRateLimiter()
+	clock, now := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	limiter.now = clock
+	return limiter, now
+}
+
+func TestRateLimiter_Take(t *testing.T) {
+	limiter, now := newTestRateLimiter()
+	limits := []rateLimit{{Key: "messages:user:grafana", PerMinute: 2}}
+
+	// The bucket starts full
+	assert.True(t, limiter.Take(limits, 1))
+	assert.True(t, limiter.Take(limits, 1))
+	assert.False(t, limiter.Take(limits, 1))
+
+	// Half a minute refills half the bucket
+	*now = now.Add(30 * time.Second)
+	assert.True(t, limiter.Take(limits, 1))
+	assert.False(t, limiter.Take(limits, 1))
+
+	// The bucket never holds more than a minute of tokens
+	*now = now.Add(time.Hour)
+	assert.False(t, limiter.Take(limits, 3))
+	assert.True(t, limiter.Take(limits, 2))
+}
+
+func TestRateLimiter_TakeAllOrNothing(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	user := rateLimit{Key: "recipients:user:grafana", PerMinute: 10}
+	ip := rateLimit{Key: "recipients:ip:10.0.0.1", PerMinute: 3}
+	disabled := rateLimit{Key: "recipients:global", PerMinute: 0}
+
+	assert.True(t, limiter.Take([]rateLimit{user, ip, disabled}, 3))
+
+	// The IP is out of tokens, so the user's aren't taken either
+	assert.False(t, limiter.Take([]rateLimit{user, ip, disabled}, 1))
+	assert.True(t, limiter.Take([]rateLimit{user}, 7))
+	assert.False(t, limiter.Take([]rateLimit{user}, 1))
+}
+
+func TestRateLimiter_Fits(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	limits := []rateLimit{{Key: "recipients:user:grafana", PerMinute: 5}, {Key: "recipients:global", PerMinute: 0}}
+
+	assert.True(t, limiter.Fits(limits, 5))
+	assert.False(t, limiter.Fits(limits, 6))
+
+	// Fitting doesn't take anything
+	assert.True(t, limiter.Take(limits, 5))
+
+	var none *RateLimiter
+	assert.True(t, none.Fits(limits, 6))
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	limiter, now := newTestRateLimiter()
+	assert.True(t, limiter.Take([]rateLimit{{Key: "messages:ip:10.0.0.1", PerMinute: 5}}, 1))
+	assert.Len(t, limiter.buckets, 1)
+
+	*now = now.Add(2 * time.Minute)
+	assert.True(t, limiter.Take([]rateLimit{{Key: "messages:ip:10.0.0.2", PerMinute: 5}}, 1))
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var limiter *RateLimiter
+	assert.True(t, limiter.Take([]rateLimit{{Key: "messages:global", PerMinute: 1}}, 5))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// RecipientPolicy decides which addresses can receive mail, as exact addresses or
+// *@domain wildcards. The deny list wins over the allow list, and an empty allow
+// list allows every address that isn't denied.
+type RecipientPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+func (p *RecipientPolicy) validate() error {
+	for _, pattern := range p.Allow {
+		if !isValidAddressPattern(pattern) {
+			return fmt.Errorf("recipient allow list: %s must be an address or *@domain", pattern)
+		}
+	}
+	for _, pattern := range p.Deny {
+		if !isValidAddressPattern(pattern) {
+			return fmt.Errorf("recipient deny list: %s must be an address or *@domain", pattern)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether mail can be sent to the address
+func (p *RecipientPolicy) Allowed(address string) bool {
+	if matchAnyAddress(p.Deny, address) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchAnyAddress(p.Allow, address)
+}
+
+func matchAnyAddress(patterns []string, address string) bool {
+	for _, pattern := range patterns {
+		if matchAddress(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecipientPolicy_Allowed(t *testing.T) {
+	// Everything is allowed by default
+	assert.True(t, (&RecipientPolicy{}).Allowed("anyone@example.com"))
+
+	policy := &RecipientPolicy{
+		Allow: []string{"*@cds-snc.ca", "partner@example.com"},
+		Deny:  []string{"ceo@cds-snc.ca"},
+	}
+	assert.True(t, policy.Allowed("someone@CDS-SNC.ca"))
+	assert.True(t, policy.Allowed("partner@example.com"))
+	assert.False(t, policy.Allowed("other@example.com"))
+
+	// The deny list wins
+	assert.False(t, policy.Allowed("ceo@cds-snc.ca"))
+
+	// A deny list on its own allows everything else
+	policy = &RecipientPolicy{Deny: []string{"*@example.com"}}
+	assert.False(t, policy.Allowed("someone@example.com"))
+	assert.True(t, policy.Allowed("someone@cds-snc.ca"))
+}
+
+func TestRecipientPolicy_validate(t *testing.T) {
+	assert.Nil(t, (&RecipientPolicy{Allow: []string{"*@cds-snc.ca"}, Deny: []string{"ceo@cds-snc.ca"}}).validate())
+	assert.Equal(t, "recipient allow list: cds-snc.ca must be an address or *@domain", (&RecipientPolicy{Allow: []string{"cds-snc.ca"}}).validate().Error())
+	assert.Equal(t, "recipient deny list: *@ must be an address or *@domain", (&RecipientPolicy{Deny: []string{"*@"}}).validate().Error())
+}
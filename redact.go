@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// How email addresses and subjects appear in the logs, set with Log_Redaction
+const (
+	redactionNone = "none"
+	redactionMask = "mask"
+	redactionHash = "hash"
+)
+
+// Loose enough to catch every address in free text, such as a Notify error response
+var addressPattern = regexp.MustCompile(`[^\s"'<>(),;:@]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// logRedactor hides the personal information in log lines, it is set up at startup
+// and leaves everything as is until then
+var logRedactor *Redactor
+
+// Redactor masks or hashes email addresses and subjects before they are logged. The
+// methods return their input on a nil Redactor.
+type Redactor struct {
+	Mode string
+
+	// Key of the HMAC used by the hash mode, the same key gives the same hashes so
+	// support can follow an address across log lines and restarts
+	Key []byte
+}
+
+func newRedactor(mode string, key string) *Redactor {
+	if mode == "" || mode == redactionNone {
+		return nil
+	}
+	return &Redactor{Mode: mode, Key: []byte(key)}
+}
+
+func isValidRedaction(mode string) bool {
+	return mode == redactionNone || mode == redactionMask || mode == redactionHash
+}
+
+// Address masks an address as j***@example.com or replaces it with its HMAC
+func (r *Redactor) Address(address string) string {
+	if r == nil || address == "" {
+		return address
+	}
+	if r.Mode == redactionHash {
+		return r.hash(strings.ToLower(strings.TrimSpace(address)))
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 1 {
+		return "***"
+	}
+	return address[:1] + "***" + address[at:]
+}
+
+// Username redacts a username that is an email address. Other usernames name a
+// service in the users file and are left as is.
+func (r *Redactor) Username(username string) string {
+	if r == nil || !strings.Contains(username, "@") {
+		return username
+	}
+	return r.Address(username)
+}
+
+// Subject hides a subject entirely, or replaces it with its HMAC
+func (r *Redactor) Subject(subject string) string {
+	if r == nil || subject == "" {
+		return subject
+	}
+	if r.Mode == redactionHash {
+		return r.hash(subject)
+	}
+	return "[redacted]"
+}
+
+// Text redacts every address found in free text
+func (r *Redactor) Text(text string) string {
+	if r == nil {
+		return text
+	}
+	return addressPattern.ReplaceAllStringFunc(text, r.Address)
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.Key)
+	mac.Write([]byte(value))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// redactAddress, redactUsername, redactSubject and redactText apply the configured redaction
+func redactAddress(address string) string {
+	return logRedactor.Address(address)
+}
+
+func redactUsername(username string) string {
+	return logRedactor.Username(username)
+}
+
+func redactSubject(subject string) string {
+	return logRedactor.Subject(subject)
+}
+
+func redactText(text string) string {
+	return logRedactor.Text(text)
+}
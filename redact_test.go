@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRedactionKey = "test-redaction-key-0123456789abcdef"
+
+func TestNewRedactor(t *testing.T) {
+	assert.Nil(t, newRedactor("", ""))
+	assert.Nil(t, newRedactor("none", ""))
+	assert.Equal(t, &Redactor{Mode: "mask", Key: []byte{}}, newRedactor("mask", ""))
+}
+
+func TestRedactor_Address(t *testing.T) {
+	var none *Redactor
+	assert.Equal(t, "jane.doe@example.com", none.Address("jane.doe@example.com"))
+
+	mask := newRedactor(redactionMask, "")
+	assert.Equal(t, "j***@example.com", mask.Address("jane.doe@example.com"))
+	assert.Equal(t, "***", mask.Address("not-an-address"))
+	assert.Equal(t, "***", mask.Address("@example.com"))
+	assert.Equal(t, "", mask.Address(""))
+
+	hash := newRedactor(redactionHash, testRedactionKey)
+	hashed := hash.Address("jane.doe@example.com")
+	assert.Regexp(t, "^hmac:[0-9a-f]{16}$", hashed)
+	assert.NotContains(t, hashed, "example.com")
+
+	// The same address hashes the same way whatever its case, but only with the same key
+	assert.Equal(t, hashed, hash.Address(" Jane.Doe@Example.com"))
+	assert.NotEqual(t, hashed, hash.Address("john.doe@example.com"))
+	assert.NotEqual(t, hashed, newRedactor(redactionHash, testRedactionKey+"2").Address("jane.doe@example.com"))
+}
+
+func TestRedactor_Username(t *testing.T) {
+	var none *Redactor
+	assert.Equal(t, "jane.doe@example.com", none.Username("jane.doe@example.com"))
+
+	mask := newRedactor(redactionMask, "")
+	assert.Equal(t, "j***@example.com", mask.Username("jane.doe@example.com"))
+	assert.Equal(t, "grafana", mask.Username("grafana"))
+
+	hash := newRedactor(redactionHash, testRedactionKey)
+	assert.Equal(t, hash.Address("jane.doe@example.com"), hash.Username("jane.doe@example.com"))
+	assert.Equal(t, "grafana", hash.Username("grafana"))
+}
+
+func TestRedactor_Subject(t *testing.T) {
+	var none *Redactor
+	assert.Equal(t, "Your passport application", none.Subject("Your passport application"))
+
+	assert.Equal(t, "[redacted]", newRedactor(redactionMask, "").Subject("Your passport application"))
+	assert.Equal(t, "", newRedactor(redactionMask, "").Subject(""))
+
+	hash := newRedactor(redactionHash, testRedactionKey)
+	assert.Regexp(t, "^hmac:[0-9a-f]{16}$", hash.Subject("Your passport application"))
+	assert.Equal(t, hash.Subject("Your passport application"), hash.Subject("Your passport application"))
+}
+
+func TestRedactor_Text(t *testing.T) {
+	body := `{"errors":[{"error":"BadRequestError","message":"Can't send to this recipient: jane.doe@example.com"}]}`
+
+	var none *Redactor
+	assert.Equal(t, body, none.Text(body))
+	assert.Equal(t, `{"errors":[{"error":"BadRequestError","message":"Can't send to this recipient: j***@example.com"}]}`, newRedactor(redactionMask, "").Text(body))
+	assert.NotContains(t, newRedactor(redactionHash, testRedactionKey).Text(body), "jane.doe")
+}
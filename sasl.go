@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SASL mechanisms that can be enabled with Auth_Mechanisms
+const (
+	mechanismPlain       = sasl.Plain
+	mechanismLogin       = sasl.Login
+	mechanismCramMd5     = "CRAM-MD5"
+	mechanismScramSha256 = "SCRAM-SHA-256"
+)
+
+var supportedMechanisms = []string{mechanismPlain, mechanismLogin, mechanismCramMd5, mechanismScramSha256}
+
+// Key used to derive the SCRAM salt of unknown users, so a client can't tell
+// whether a username exists from the server-first message
+var scramFakeSaltKey = randomBytes(32)
+
+func isSupportedMechanism(mechanism string) bool {
+	return slices.Contains(supportedMechanisms, mechanism)
+}
+
+// parseMechanisms reads a comma separated list of mechanisms such as PLAIN,LOGIN
+func parseMechanisms(value string) []string {
+	mechanisms := []string{}
+	for _, mechanism := range strings.Split(value, ",") {
+		if mechanism = strings.ToUpper(strings.TrimSpace(mechanism)); mechanism != "" {
+			mechanisms = append(mechanisms, mechanism)
+		}
+	}
+	return mechanisms
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// cramMd5Server implements CRAM-MD5 as described in RFC 2195
+type cramMd5Server struct {
+	hostname     string
+	challenge    []byte
+	authenticate func(username string, challenge []byte, digest []byte) error
+}
+
+func newCramMd5Server(hostname string, authenticate func(username string, challenge []byte, digest []byte) error) sasl.Server {
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	return &cramMd5Server{hostname: hostname, authenticate: authenticate}
+}
+
+func (a *cramMd5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.challenge == nil {
+		if len(response) > 0 {
+			return nil, true, errors.New("CRAM-MD5 does not accept an initial response")
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			return nil, true, err
+		}
+		a.challenge = []byte(fmt.Sprintf("<%d.%d@%s>", n, time.Now().Unix(), a.hostname))
+		return a.challenge, false, nil
+	}
+
+	// The response is the username and the hex digest separated by the last space
+	i := strings.LastIndex(string(response), " ")
+	if i < 0 {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	return nil, true, a.authenticate(string(response[:i]), a.challenge, digest)
+}
+
+type scramState int
+
+const (
+	scramWaitingClientFirst scramState = iota
+	scramWaitingClientFinal
+	scramWaitingAck
+)
+
+// scramServer implements SCRAM-SHA-256 as described in RFC 5802 and RFC 7677,
+// without channel binding
+type scramServer struct {
+	state        scramState
+	credentials  func(username string) *scramCredentials
+	authenticate func(username string, verified bool) error
+
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	keys            *scramCredentials
+}
+
+func newScramServer(credentials func(username string) *scramCredentials, authenticate func(username string, verified bool) error) sasl.Server {
+	return &scramServer{credentials: credentials, authenticate: authenticate}
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.state {
+	case scramWaitingClientFirst:
+		// Ask for the client-first message when there was no initial response
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		if err := a.readClientFirst(string(response)); err != nil {
+			return nil, true, err
+		}
+		a.state = scramWaitingClientFinal
+		return []byte(a.serverFirst), false, nil
+
+	case scramWaitingClientFinal:
+		serverFinal, err := a.readClientFinal(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		a.state = scramWaitingAck
+		return []byte(serverFinal), false, nil
+
+	case scramWaitingAck:
+		if len(response) > 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, a.authenticate(a.username, true)
+	}
+
+	return nil, true, sasl.ErrUnexpectedClientResponse
+}
+
+func (a *scramServer) readClientFirst(message string) error {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return sasl.ErrUnexpectedClientResponse
+	}
+
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return errors.New("SCRAM channel binding is not supported")
+	default:
+		return sasl.ErrUnexpectedClientResponse
+	}
+
+	a.gs2Header = parts[0] + "," + parts[1] + ","
+	a.clientFirstBare = parts[2]
+
+	attributes := scramAttributes(a.clientFirstBare)
+	if _, ok := attributes["m"]; ok {
+		return errors.New("SCRAM extensions are not supported")
+	}
+
+	username, ok := attributes["n"]
+	if !ok || username == "" {
+		return sasl.ErrUnexpectedClientResponse
+	}
+	a.username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(username)
+
+	if authzid := parts[1]; authzid != "" && strings.TrimPrefix(authzid, "a=") != username {
+		return errors.New("identities not supported")
+	}
+
+	clientNonce, ok := attributes["r"]
+	if !ok || clientNonce == "" {
+		return sasl.ErrUnexpectedClientResponse
+	}
+	a.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(randomBytes(18))
+
+	// Unknown users get made up keys so the exchange looks the same until the proof fails
+	a.keys = a.credentials(a.username)
+	if a.keys == nil {
+		salt := hmac.New(sha256.New, scramFakeSaltKey)
+		salt.Write([]byte(a.username))
+		a.keys = &scramCredentials{
+			iterations: scramIterations,
+			salt:       salt.Sum(nil)[:scramSaltLen],
+			storedKey:  randomBytes(sha256.Size),
+			serverKey:  randomBytes(sha256.Size),
+		}
+	}
+
+	a.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", a.nonce, base64.StdEncoding.EncodeToString(a.keys.salt), a.keys.iterations)
+	return nil
+}
+
+func (a *scramServer) readClientFinal(message string) (string, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return "", sasl.ErrUnexpectedClientResponse
+	}
+	withoutProof := message[:i]
+
+	attributes := scramAttributes(withoutProof)
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(a.gs2Header)) || attributes["r"] != a.nonce {
+		return "", sasl.ErrUnexpectedClientResponse
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(message[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return "", sasl.ErrUnexpectedClientResponse
+	}
+
+	authMessage := a.clientFirstBare + "," + a.serverFirst + "," + withoutProof
+
+	// Recover the client key from the proof and check it hashes to the stored key
+	clientSignature := hmacSha256(a.keys.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], a.keys.storedKey) != 1 {
+		return "", a.authenticate(a.username, false)
+	}
+
+	serverSignature := hmacSha256(a.keys.serverKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// scramAttributes splits a SCRAM message into its attributes, keeping the first of each
+func scramAttributes(message string) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		key, value, ok := strings.Cut(attribute, "=")
+		if !ok {
+			continue
+		}
+		if _, seen := attributes[key]; !seen {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClientFinal returns the client-final message a client sends with the password,
+// and the server-final message it expects back
+func scramClientFinal(password string, clientFirstBare string, serverFirst string) (string, string) {
+	attributes := scramAttributes(serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	iterations, _ := strconv.Atoi(attributes["i"])
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSha256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSha256(saltedPassword, "Server Key")
+
+	withoutProof := "c=biws,r=" + attributes["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	proof := hmacSha256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		"v=" + base64.StdEncoding.EncodeToString(hmacSha256(serverKey, authMessage))
+}
+
+// scramAuthenticator records the result of a SCRAM-SHA-256 exchange
+type scramAuthenticator struct {
+	username string
+	verified bool
+}
+
+func (a *scramAuthenticator) authenticate(username string, verified bool) error {
+	a.username = username
+	a.verified = verified
+	if !verified {
+		return errors.New("invalid username or password")
+	}
+	return nil
+}
+
+func TestScramServer(t *testing.T) {
+	hash, err := hashPasswordScram("longpasswordgo")
+	assert.Nil(t, err)
+	credentials, err := parseScramHash(hash)
+	assert.Nil(t, err)
+
+	authenticator := &scramAuthenticator{}
+	server := newScramServer(func(username string) *scramCredentials {
+		if username == "user,name" {
+			return credentials
+		}
+		return nil
+	}, authenticator.authenticate)
+
+	// Without an initial response the server asks for the client-first message
+	challenge, done, err := server.Next(nil)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Empty(t, challenge)
+
+	clientFirstBare := "n=user=2Cname,r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst, done, err := server.Next([]byte("n,," + clientFirstBare))
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Regexp(t, `^r=fyko\+d2lbbFgONRv9qkxdawL[A-Za-z0-9+/]+,s=[A-Za-z0-9+/=]+,i=4096$`, string(serverFirst))
+
+	clientFinal, expectedServerFinal := scramClientFinal("longpasswordgo", clientFirstBare, string(serverFirst))
+	serverFinal, done, err := server.Next([]byte(clientFinal))
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Equal(t, expectedServerFinal, string(serverFinal))
+
+	_, done, err = server.Next([]byte{})
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "user,name", authenticator.username)
+	assert.True(t, authenticator.verified)
+}
+
+func TestScramServer_WrongPassword(t *testing.T) {
+	hash, err := hashPasswordScram("longpasswordgo")
+	assert.Nil(t, err)
+	credentials, err := parseScramHash(hash)
+	assert.Nil(t, err)
+
+	authenticator := &scramAuthenticator{}
+	server := newScramServer(func(username string) *scramCredentials {
+		return credentials
+	}, authenticator.authenticate)
+
+	clientFirstBare := "n=username,r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst, _, err := server.Next([]byte("n,," + clientFirstBare))
+	assert.Nil(t, err)
+
+	clientFinal, _ := scramClientFinal("longpasswordgo1", clientFirstBare, string(serverFirst))
+	_, done, err := server.Next([]byte(clientFinal))
+	assert.Equal(t, "invalid username or password", err.Error())
+	assert.True(t, done)
+	assert.False(t, authenticator.verified)
+}
+
+func TestScramServer_UnknownUser(t *testing.T) {
+	authenticator := &scramAuthenticator{}
+	newServer := func() *scramServer {
+		return newScramServer(func(username string) *scramCredentials {
+			return nil
+		}, authenticator.authenticate).(*scramServer)
+	}
+
+	// The salt of an unknown user is the same every time, like a real one
+	first := newServer()
+	_, _, err := first.Next([]byte("n,,n=unknown,r=abc"))
+	assert.Nil(t, err)
+	second := newServer()
+	_, _, err = second.Next([]byte("n,,n=unknown,r=abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, first.keys.salt, second.keys.salt)
+
+	clientFinal, _ := scramClientFinal("longpasswordgo", "n=unknown,r=abc", first.serverFirst)
+	_, _, err = first.Next([]byte(clientFinal))
+	assert.Equal(t, "invalid username or password", err.Error())
+}
+
+func TestScramServer_InvalidMessages(t *testing.T) {
+	newServer := func() *scramServer {
+		return newScramServer(func(username string) *scramCredentials {
+			return nil
+		}, (&scramAuthenticator{}).authenticate).(*scramServer)
+	}
+
+	_, _, err := newServer().Next([]byte("p=tls-unique,,n=username,r=abc"))
+	assert.Equal(t, "SCRAM channel binding is not supported", err.Error())
+
+	_, _, err = newServer().Next([]byte("n,a=admin,n=username,r=abc"))
+	assert.Equal(t, "identities not supported", err.Error())
+
+	_, _, err = newServer().Next([]byte("n,,m=ext,n=username,r=abc"))
+	assert.Equal(t, "SCRAM extensions are not supported", err.Error())
+
+	_, _, err = newServer().Next([]byte("n,,n=username"))
+	assert.NotNil(t, err)
+
+	// The nonce in the client-final message must be the combined nonce
+	server := newServer()
+	_, _, err = server.Next([]byte("n,,n=username,r=abc"))
+	assert.Nil(t, err)
+	_, _, err = server.Next([]byte("c=biws,r=abc,p=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))))
+	assert.NotNil(t, err)
+}
+
+func TestCramMd5Server(t *testing.T) {
+	var username string
+	server := newCramMd5Server("localhost", func(u string, challenge []byte, digest []byte) error {
+		username = u
+		mac := hmac.New(md5.New, []byte("longpasswordgo"))
+		mac.Write(challenge)
+		if !hmac.Equal(mac.Sum(nil), digest) {
+			return errors.New("invalid username or password")
+		}
+		return nil
+	})
+
+	challenge, done, err := server.Next(nil)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.Regexp(t, `^<\d+\.\d+@localhost>$`, string(challenge))
+
+	mac := hmac.New(md5.New, []byte("longpasswordgo"))
+	mac.Write(challenge)
+	_, done, err = server.Next([]byte(fmt.Sprintf("user name %s", hex.EncodeToString(mac.Sum(nil)))))
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "user name", username)
+}
+
+func TestCramMd5Server_InvalidResponse(t *testing.T) {
+	server := newCramMd5Server("", func(username string, challenge []byte, digest []byte) error {
+		return nil
+	})
+
+	_, _, err := server.Next([]byte("initial response"))
+	assert.Equal(t, "CRAM-MD5 does not accept an initial response", err.Error())
+
+	server = newCramMd5Server("", func(username string, challenge []byte, digest []byte) error {
+		return nil
+	})
+	challenge, _, err := server.Next(nil)
+	assert.Nil(t, err)
+	assert.Regexp(t, `@localhost>$`, string(challenge))
+
+	_, _, err = server.Next([]byte("username not-hex"))
+	assert.NotNil(t, err)
+}
+
+func TestParseMechanisms(t *testing.T) {
+	assert.Equal(t, []string{"PLAIN", "LOGIN", "SCRAM-SHA-256"}, parseMechanisms("plain, LOGIN,,scram-sha-256 "))
+	assert.Empty(t, parseMechanisms(""))
+}
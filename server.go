@@ -1,71 +1,487 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/DusanKasan/parsemail"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errIpLockedOut = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed logins, try again later",
+	}
+	errUsernameLockedOut = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Too many failed logins for this user, try again later",
+	}
+	errSenderNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not allowed",
+	}
+	errRecipientNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient address not allowed",
+	}
+	errQuotaReached = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Daily sending quota reached, try again tomorrow",
+	}
+	errRateLimited = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Rate limit exceeded, try again later",
+	}
+	errOverRateLimit = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 3},
+		Message:      "Too many recipients for the rate limit",
+	}
 )
 
 type Backend struct {
-	Config *Config
+	Client      *NotifyClient
+	Clients     map[string]*NotifyClient
+	Config      *Config
+	Lockout     *Lockout
+	Metrics     *Metrics
+	RateLimiter *RateLimiter
+	Spool       *Spool
 }
 
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{
+	// go-smtp starts a new session on every EHLO without logging out of the one it
+	// replaces, so that one ends here
+	if c != nil {
+		if previous, ok := c.Session().(*Session); ok {
+			previous.endSessionSpan()
+		}
+	}
+
+	session := &Session{
 		Authenticated: false,
+		Client:        bkd.Client,
+		Clients:       bkd.Clients,
 		Config:        bkd.Config,
+		Lockout:       bkd.Lockout,
+		Metrics:       bkd.Metrics,
+		RateLimiter:   bkd.RateLimiter,
+		RemoteIp:      remoteIp(c),
+		Spool:         bkd.Spool,
 		Email: &NotifyEmail{
 			TemplateId: bkd.Config.Notify.TemplateId,
 		},
-	}, nil
+	}
+
+	session.Id = newSessionId()
+	logger := log.With().Str("session_id", session.Id).Str("remote_ip", session.RemoteIp).Logger()
+	session.Logger = &logger
+	session.startSessionSpan()
+
+	// Clients from a tenant's trusted networks don't need to authenticate
+	if addr, err := netip.ParseAddr(session.RemoteIp); err == nil {
+		if tenant := bkd.Config.relayTenant(addr); tenant != nil {
+			session.startRelay(tenant)
+		}
+	}
+
+	return session, nil
 }
 
 type Session struct {
 	Authenticated bool
+	Client        *NotifyClient
+	Clients       map[string]*NotifyClient
 	Config        *Config
 	Email         *NotifyEmail
+	From          string
+	Id            string
+	Lockout       *Lockout
+	Logger        *zerolog.Logger
+	Metrics       *Metrics
+	RateLimiter   *RateLimiter
+	Relay         bool
+	RemoteIp      string
+	Spool         *Spool
+	Tenant        *Tenant
+	Username      string
+
+	// Number of the current mail transaction, counted from 1 at each MAIL FROM
+	Transaction int
+
+	// Spans of the connection and of the current mail transaction
+	ctx             context.Context
+	span            trace.Span
+	transactionCtx  context.Context
+	transactionSpan trace.Span
+}
+
+// newSessionId returns a random ID that ties together the logs of a session
+func newSessionId() string {
+	return hex.EncodeToString(randomBytes(8))
 }
 
+// remoteIp returns the IP address of the client
+func remoteIp(c *smtp.Conn) string {
+	if c == nil || c.Conn() == nil {
+		return ""
+	}
+
+	addr := c.Conn().RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// AuthMechanisms lists the SASL mechanisms advertised in the EHLO response
+func (s *Session) AuthMechanisms() []string {
+	return s.Config.Auth.Mechanisms
+}
+
+// Auth starts one of the enabled SASL mechanisms
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if !slices.Contains(s.Config.Auth.Mechanisms, mech) {
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+
+	if remaining := s.Lockout.IpLocked(s.RemoteIp); remaining > 0 {
+		s.securityEvent("auth_locked_out", "").Dur("remaining", remaining).Msgf("Rejected login from locked out IP %s", s.RemoteIp)
+		return nil, errIpLockedOut
+	}
+
+	switch mech {
+	case mechanismPlain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errors.New("identities not supported")
+			}
+			return s.AuthPlain(username, password)
+		}), nil
+	case mechanismLogin:
+		return sasl.NewLoginServer(s.AuthPlain), nil
+	case mechanismCramMd5:
+		return newCramMd5Server(s.Config.Smtp.Hostname, s.authCramMd5), nil
+	case mechanismScramSha256:
+		return newScramServer(s.scramCredentials, s.authScram), nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// AuthPlain checks a password, sent with either PLAIN or LOGIN
 func (s *Session) AuthPlain(username, password string) error {
-	if username != s.Config.Smtp.Username || password != s.Config.Smtp.Password {
-		log.Error().Msgf("Invalid username or password: %s", username)
+	return s.login(username, func(tenant *Tenant) bool {
+		return verifyPassword(tenant.Password, password, s.Config.Auth.AllowPlaintextPasswords)
+	})
+}
+
+// authCramMd5 checks the keyed digest of the challenge, which needs a plaintext password
+func (s *Session) authCramMd5(username string, challenge []byte, digest []byte) error {
+	return s.login(username, func(tenant *Tenant) bool {
+		if !s.Config.Auth.AllowPlaintextPasswords || isPasswordHash(tenant.Password) {
+			return false
+		}
+		mac := hmac.New(md5.New, []byte(tenant.Password))
+		mac.Write(challenge)
+		return hmac.Equal(mac.Sum(nil), digest)
+	})
+}
+
+// scramCredentials returns the SCRAM-SHA-256 keys of a user, derived from the password
+// when plaintext passwords are allowed, or nil if the user can't use SCRAM-SHA-256
+func (s *Session) scramCredentials(username string) *scramCredentials {
+	tenant := s.Config.lookupTenant(username)
+	switch {
+	case tenant == nil:
+		return nil
+	case isScramHash(tenant.Password):
+		credentials, err := parseScramHash(tenant.Password)
+		if err != nil {
+			return nil
+		}
+		return credentials
+	case s.Config.Auth.AllowPlaintextPasswords && !isPasswordHash(tenant.Password):
+		return newScramCredentials(tenant.Password, randomBytes(scramSaltLen), scramIterations)
+	}
+	return nil
+}
+
+// authScram signs in once the SCRAM-SHA-256 proof has been checked
+func (s *Session) authScram(username string, verified bool) error {
+	return s.login(username, func(tenant *Tenant) bool {
+		return verified
+	})
+}
+
+// logger returns the session's logger, which carries the fields identifying the
+// session, and the username and transaction number once there are some
+func (s *Session) logger() *zerolog.Logger {
+	logger := &log.Logger
+	if s.Logger != nil {
+		logger = s.Logger
+	}
+	if s.Username == "" && s.Transaction == 0 {
+		return logger
+	}
+
+	context := logger.With()
+	if s.Username != "" {
+		context = context.Str("username", redactUsername(s.Username))
+	}
+	if s.Transaction > 0 {
+		context = context.Int("transaction", s.Transaction)
+	}
+	child := context.Logger()
+	return &child
+}
+
+// requestId identifies the current mail transaction in the requests sent to Notify
+func (s *Session) requestId() string {
+	return fmt.Sprintf("%s-%d", s.Id, s.Transaction)
+}
+
+// securityEvent starts a structured log event about a login attempt. The username
+// is only added when it isn't already the session's.
+func (s *Session) securityEvent(event string, username string) *zerolog.Event {
+	e := s.logger().Warn().Str("event", event)
+	if username != s.Username {
+		e = e.Str("username", redactUsername(username))
+	}
+	return e
+}
+
+// startRelay lets a client from one of the tenant's trusted networks send as the
+// tenant without authenticating
+func (s *Session) startRelay(tenant *Tenant) {
+	logger := s.logger().With().Bool("relay", true).Str("tenant", redactUsername(tenant.Username)).Logger()
+	s.Logger = &logger
+
+	s.Relay = true
+	s.Authenticated = true
+	s.Username = tenant.Username
+	s.useTenant(tenant)
+
+	s.logger().Warn().Str("event", "relay_session").Msgf("Unauthenticated relay session from %s as %s", s.RemoteIp, redactUsername(tenant.Username))
+}
+
+// login signs in as the user's tenant if verify accepts the credentials
+func (s *Session) login(username string, verify func(tenant *Tenant) bool) (err error) {
+	_, span := tracer().Start(s.context(), "smtp.auth", trace.WithAttributes(attribute.String("smtp.username", redactUsername(username))))
+	defer func() { endSpan(span, err) }()
+
+	if remaining := s.Lockout.IpLocked(s.RemoteIp); remaining > 0 {
+		s.securityEvent("auth_locked_out", username).Dur("remaining", remaining).Msgf("Rejected login from locked out IP %s", s.RemoteIp)
+		s.Metrics.Auth(false)
+		s.Authenticated = false
+		return errIpLockedOut
+	}
+
+	// Locked out usernames are rejected without checking the password
+	if remaining := s.Lockout.UsernameLocked(username); remaining > 0 {
+		s.securityEvent("auth_locked_out", username).Dur("remaining", remaining).Msgf("Rejected login for locked out user %s", redactUsername(username))
+		s.Metrics.Auth(false)
+		s.Authenticated = false
+		return errUsernameLockedOut
+	}
+
+	tenant := s.Config.lookupTenant(username)
+	if tenant == nil || !verify(tenant) {
+		s.logger().Error().Msgf("Invalid username or password: %s", redactUsername(username))
+		for _, entry := range s.Lockout.Failure(s.RemoteIp, username) {
+			value := entry.Value
+			if entry.Kind == lockoutKindUsername {
+				value = redactUsername(value)
+			}
+			s.securityEvent("auth_lockout", username).Str("kind", entry.Kind).Str("value", value).Time("locked_until", entry.LockedUntil).Msgf("Locked out %s %s after too many failed logins", entry.Kind, value)
+		}
+		s.Metrics.Auth(false)
 		s.Authenticated = false
-		s.Logout()
 		return errors.New("invalid username or password")
 	}
-	log.Info().Msgf("User %s logged in", username)
+	s.Metrics.Auth(true)
+	s.Lockout.Success(username)
 	s.Authenticated = true
+	s.Username = username
+	s.useTenant(tenant)
+	s.logger().Info().Msgf("User %s logged in", redactUsername(username))
 	return nil
 }
 
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+// recipientAllowed checks an address against the server wide and the tenant's recipient policies
+func (s *Session) recipientAllowed(address string) bool {
+	if s.Config != nil && !s.Config.Recipients.Allowed(address) {
+		return false
+	}
+	return s.Tenant == nil || s.Tenant.Recipients.Allowed(address)
+}
+
+// quotaExceeded reports whether sending to n recipients would go over the daily quota
+// of the session's API key
+func (s *Session) quotaExceeded(n int) bool {
+	if s.Client == nil || !s.Client.Quota.Exceeded(s.Client.ApiKey, s.Client.DailyQuota, n) {
+		return false
+	}
+	s.logger().Warn().Str("event", "quota_exceeded").Str("api_key", apiKeyName(s.Client.ApiKey)).Msg("Refused mail over the daily quota")
+	return true
+}
+
+// takeRateLimit takes n messages or recipients from the tenant, remote IP and global
+// rate limits, and returns the reply to send when the session is over them
+func (s *Session) takeRateLimit(kind string, n int) error {
+	if s.Config == nil {
+		return nil
+	}
+
+	limits := s.Config.rateLimits(kind)
+	tenantLimit := limits.User
+	if s.Tenant != nil {
+		if perMinute := s.Tenant.Limits.perMinute(kind); perMinute > 0 {
+			tenantLimit = perMinute
+		}
+	}
+
+	buckets := []rateLimit{
+		{Key: kind + ":user:" + s.Username, PerMinute: tenantLimit},
+		{Key: kind + ":ip:" + s.RemoteIp, PerMinute: limits.Ip},
+		{Key: kind + ":global", PerMinute: limits.Global},
+	}
+
+	// A retry would be refused forever, so the client is told not to
+	if !s.RateLimiter.Fits(buckets, n) {
+		s.logger().Warn().Str("event", "rate_limited").Str("limit", kind).Msgf("Refused %d %s, more than a rate limit allows in a minute", n, kind)
+		return errOverRateLimit
+	}
+
+	if s.RateLimiter.Take(buckets, n) {
+		return nil
+	}
+
+	s.logger().Warn().Str("event", "rate_limited").Str("limit", kind).Msgf("Rate limit exceeded for %s", kind)
+	return errRateLimited
+}
+
+// useTenant sends the rest of the session as the tenant's Notify service
+func (s *Session) useTenant(tenant *Tenant) {
+	s.Tenant = tenant
+	client, ok := s.Clients[tenant.Username]
+	if ok {
+		s.Client = client
+	}
+	if s.Email != nil {
+		// The single user of Smtp_Username sends with the default client, which the
+		// spool uses for emails without a tenant
+		if ok {
+			s.Email.Tenant = tenant.Username
+		}
+		if tenant.TemplateId != "" {
+			s.Email.TemplateId = tenant.TemplateId
+		}
+	}
+}
+
+// tooManyRecipients reports whether the tenant's recipient limit is exceeded
+func (s *Session) tooManyRecipients(count int) bool {
+	return s.Tenant != nil && s.Tenant.Limits.MaxRecipients > 0 && count > s.Tenant.Limits.MaxRecipients
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	// Messages refused before DATA count as rejected
+	defer func() {
+		if err != nil {
+			s.Metrics.Message(err)
+			s.failTransaction(err)
+		}
+	}()
+
 	if !s.Authenticated {
-		s.Logout()
 		return errors.New("not authenticated")
 	}
-	log.Info().Msgf("Mail from: %s", from)
+
+	// Each MAIL FROM starts a new transaction, which the Notify requests are tagged with
+	s.Transaction++
+	s.startTransactionSpan()
+	if s.Email != nil {
+		s.Email.RequestId = s.requestId()
+		s.Email.Logger = s.logger()
+		s.Email.Context = s.context()
+	}
+
+	s.logger().Info().Msgf("Mail from: %s", redactAddress(from))
+	if s.Tenant != nil && !s.Tenant.senderAllowed(from) {
+		s.securityEvent("sender_rejected", s.Username).Str("sender", redactAddress(from)).Msgf("Rejected sender %s", redactAddress(from))
+		return errSenderNotAllowed
+	}
+	if s.quotaExceeded(1) {
+		return errQuotaReached
+	}
+	if err := s.takeRateLimit(rateLimitMessages, 1); err != nil {
+		return err
+	}
+	s.From = from
 	return nil
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	if !s.Authenticated {
-		s.Logout()
 		return errors.New("not authenticated")
 	}
-	log.Info().Msgf("Rcpt to: %s", to)
+	if !s.recipientAllowed(to) {
+		s.securityEvent("recipient_rejected", s.Username).Str("recipient", redactAddress(to)).Msgf("Rejected recipient %s", redactAddress(to))
+		return errRecipientNotAllowed
+	}
+	if s.tooManyRecipients(len(s.Email.Emails) + 1) {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients",
+		}
+	}
+	if s.quotaExceeded(len(s.Email.Emails) + 1) {
+		return errQuotaReached
+	}
+	if err := s.takeRateLimit(rateLimitRecipients, 1); err != nil {
+		return err
+	}
+	s.logger().Info().Msgf("Rcpt to: %s", redactAddress(to))
 	s.Email.Emails = append(s.Email.Emails, to)
+	s.Metrics.Recipients(1)
 	return nil
 }
 
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (err error) {
+	ctx, span := tracer().Start(s.context(), "smtp.data")
+	defer func() {
+		s.Metrics.Message(err)
+		s.failTransaction(err)
+		endSpan(span, err)
+	}()
+
 	if !s.Authenticated {
 		return errors.New("not authenticated")
 	}
@@ -74,32 +490,105 @@ func (s *Session) Data(r io.Reader) error {
 		return err
 	} else {
 		// Parse the email
+		span.SetAttributes(attribute.Int("smtp.message_bytes", len(data)))
+		_, parseSpan := tracer().Start(ctx, "smtp.parse")
 		email, err := parsemail.Parse(strings.NewReader(string(data)))
+		if err == nil {
+			parseSpan.SetAttributes(attribute.Int("smtp.attachments", len(email.Attachments)))
+		}
+		endSpan(parseSpan, err)
 
 		if err != nil {
-			log.Error().Msgf("Error parsing email: %s", err)
+			s.logger().Error().Msgf("Error parsing email: %s", err)
 			return err
 		}
+		s.logger().Debug().Str("subject", redactSubject(email.Subject)).Int("attachments", len(email.Attachments)).Msg("Received message")
 
-		// Add cc emails
-		for _, address := range email.Cc {
-			s.Email.Emails = append(s.Email.Emails, address.Address)
+		// Check the From: header when the tenant asks for it
+		if s.Tenant != nil && s.Tenant.CheckHeaderFrom && len(s.Tenant.AllowedSenders) > 0 {
+			if len(email.From) == 0 {
+				s.securityEvent("sender_rejected", s.Username).Msg("Rejected message without a From: header")
+				return errSenderNotAllowed
+			}
+			for _, address := range email.From {
+				if !s.Tenant.senderAllowed(address.Address) {
+					s.securityEvent("sender_rejected", s.Username).Str("sender", redactAddress(address.Address)).Msgf("Rejected From: header address %s", redactAddress(address.Address))
+					return errSenderNotAllowed
+				}
+			}
 		}
 
-		// Add bcc emails
-		for _, address := range email.Bcc {
+		// Add cc and bcc emails, which have to pass the same policy as RCPT TO
+		for _, address := range append(email.Cc, email.Bcc...) {
+			if !s.recipientAllowed(address.Address) {
+				s.securityEvent("recipient_rejected", s.Username).Str("recipient", redactAddress(address.Address)).Msgf("Rejected Cc or Bcc recipient %s", redactAddress(address.Address))
+				return errRecipientNotAllowed
+			}
 			s.Email.Emails = append(s.Email.Emails, address.Address)
 		}
 
+		if s.tooManyRecipients(len(s.Email.Emails)) {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 3},
+				Message:      "Too many recipients",
+			}
+		}
+
+		if s.quotaExceeded(len(s.Email.Emails)) {
+			return errQuotaReached
+		}
+
+		// Cc and Bcc addresses count towards the recipient rate limits too
+		copies := len(email.Cc) + len(email.Bcc)
+		if copies > 0 {
+			if err := s.takeRateLimit(rateLimitRecipients, copies); err != nil {
+				return err
+			}
+		}
+		s.Metrics.Recipients(copies)
+
+		// Pick the template for this message
+		templateId, err := selectTemplate(s.Config.Routing.Rules, s.Email.TemplateId, &TemplateMessage{
+			From:       s.From,
+			Header:     email.Header,
+			Recipients: s.Email.Emails,
+			Subject:    email.Subject,
+			Username:   s.Username,
+		})
+		if err != nil {
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      err.Error(),
+			}
+		}
+		s.Email.TemplateId = templateId
+
+		// Extra personalisation fields come from headers, which are then removed
+		s.Email.Personalisation.Fields = extractPersonalisation(email.Header, s.Config.Message.PersonalisationKeyTransform)
+		stripControlHeaders(email.Header)
+
 		s.Email.Personalisation.Subject = email.Subject
 		s.Email.Personalisation.Body = email.TextBody
 
+		// Many applications only send HTML, so convert it to the markdown Notify understands
+		if email.HTMLBody != "" && (s.Config.Message.PreferHtml || strings.TrimSpace(email.TextBody) == "") {
+			body, err := htmlToMarkdown(email.HTMLBody)
+			if err != nil {
+				s.logger().Error().Msgf("Error converting HTML body: %s", err)
+			} else {
+				s.Email.Personalisation.Body = body
+			}
+		}
+
 		// Add attachments
 		for _, attachment := range email.Attachments {
 			attachment_data, err := io.ReadAll(attachment.Data)
 			if err != nil {
 				return err
 			}
+			s.Metrics.AttachmentBytes(len(attachment_data))
 			s.Email.Attachments = append(s.Email.Attachments, Attachment{
 				File:          b64.StdEncoding.EncodeToString(attachment_data),
 				Filename:      attachment.Filename,
@@ -107,30 +596,150 @@ func (s *Session) Data(r io.Reader) error {
 			})
 		}
 
-		client := newNotifyClient(s.Config.Notify.ApiKey, s.Config.Notify.Hostname)
-		if err := sendEmail(client, s.Email); err != nil {
-			return err
+		// Queue the email and let the delivery worker send it to Notify
+		s.Email.Context = ctx
+		if s.Spool != nil {
+			id, err := s.Spool.Enqueue(s.Email)
+			if err != nil {
+				s.logger().Error().Msgf("Error spooling email: %s", err)
+				return err
+			}
+			s.logger().Info().Msgf("Email queued as %s", id)
+			return queuedReply(id)
+		}
+
+		if err := sendEmail(s.Client, s.Email); err != nil {
+			s.logDroppedRecipients(err)
+			return toSmtpError(err)
 		}
 	}
 	return nil
 }
 
+// logDroppedRecipients logs the recipients that failed temporarily when others got
+// the email. The client is told it was sent so that it doesn't send it again, and
+// without a spool nothing retries them.
+func (s *Session) logDroppedRecipients(err error) {
+	var deliveryErr *DeliveryError
+	if !errors.As(err, &deliveryErr) || deliveryErr.Sent == 0 {
+		return
+	}
+
+	dropped := []string{}
+	for _, result := range deliveryErr.Failed {
+		if !result.Permanent {
+			dropped = append(dropped, redactAddress(result.EmailAddress))
+		}
+	}
+	if len(dropped) > 0 {
+		s.logger().Error().Str("event", "recipients_dropped").Strs("recipients", dropped).Msgf("Not retrying %d of %d recipients that failed temporarily", len(dropped), deliveryErr.Total)
+	}
+}
+
+// queuedReply is returned from Data so the client is told the queue ID of its message
+func queuedReply(id string) error {
+	return &smtp.SMTPError{
+		Code:         250,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      fmt.Sprintf("OK: queued as %s", id),
+	}
+}
+
 func (s *Session) Reset() {
-	s.Authenticated = false
+	s.endTransactionSpan()
+	s.Authenticated = s.Relay
+	s.From = ""
 	s.Email = new(NotifyEmail)
 	s.Email.TemplateId = s.Config.Notify.TemplateId
+	if s.Tenant != nil {
+		s.useTenant(s.Tenant)
+	}
 }
 
+// Logout is called when the client disconnects or starts TLS, which begins a new session
 func (s *Session) Logout() error {
 	s.Authenticated = false
+	s.endSessionSpan()
 	return nil
 }
 
 func startSmtpServer(config *Config) {
+	client, err := newSharedNotifyClient(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create Notify client")
+	}
+
+	quota, err := newQuota(config.Quota.StateFile, config.Quota.WarnThresholds)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load quota state")
+	}
+	client.Quota = quota
+
+	status := statusServers{}
+
+	var metrics *Metrics
+	if config.Metrics.Addr != "" {
+		metrics = newMetrics()
+		metrics.RegisterQuota(quota)
+		client.Metrics = metrics
+		status.Handle(config.Metrics.Addr, "/metrics", metrics.Handler())
+	}
+
+	health := newHealth(client.Client, config.notifyHostnames())
+	if config.Health.Addr != "" {
+		status.Handle(config.Health.Addr, "/healthz", http.HandlerFunc(health.handleLive))
+		status.Handle(config.Health.Addr, "/readyz", http.HandlerFunc(health.handleReady))
+	}
+
+	// Every tenant shares the connections and concurrency limit of the default client
+	clients := map[string]*NotifyClient{}
+	for _, tenant := range config.Auth.Users {
+		clients[tenant.Username] = client.forTenant(tenant)
+	}
+
 	backend := &Backend{
-		Config: config,
+		Client:      client,
+		Clients:     clients,
+		Config:      config,
+		Lockout:     newLockout(config.ipLockoutPolicy(), config.usernameLockoutPolicy()),
+		Metrics:     metrics,
+		RateLimiter: newRateLimiter(),
 	}
 
+	if config.Admin.Addr != "" {
+		go startAdminServer(&AdminServer{Config: config, Lockout: backend.Lockout, Quota: quota})
+	}
+
+	if config.Spool.Enabled {
+		spool, err := newSpool(config.Spool.Dir, config.Spool.MaxAge)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open spool")
+		}
+		spool.Clients = clients
+		backend.Spool = spool
+		metrics.RegisterSpool(spool)
+
+		go startDeliveryWorker(spool, client, config.Spool.PollInterval)
+	}
+
+	// Load the certificate before the status servers start, as readiness reads its
+	// expiry
+	var tlsConfig *tls.Config
+	if config.Smtp.UseTLS {
+		cer, err := tls.LoadX509KeyPair(config.Smtp.TlsCertFile, config.Smtp.TlsKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load TLS certificate")
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
+
+		// Readiness fails once the certificate expires
+		if leaf, err := x509.ParseCertificate(cer.Certificate[0]); err == nil {
+			health.CertExpiry = leaf.NotAfter
+		}
+	}
+
+	status.start()
+
 	s := smtp.NewServer(backend)
 
 	s.Addr = fmt.Sprintf("%s:%d", config.Smtp.Hostname, config.Smtp.Port)
@@ -140,25 +749,31 @@ func startSmtpServer(config *Config) {
 	s.MaxMessageBytes = 10485760
 	s.MaxRecipients = 10
 
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("SMTP server failed to listen")
+	}
+	health.Listening()
+
 	if config.Smtp.UseTLS {
 		s.AllowInsecureAuth = false
 		s.EnableREQUIRETLS = true
+		s.TLSConfig = tlsConfig
 
-		cer, err := tls.LoadX509KeyPair(config.Smtp.TlsCertFile, config.Smtp.TlsKeyFile)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to load TLS certificate")
-		}
-		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
+		// Filter after TLS so rejected clients can read the banner
+		listener = newFilteredListener(tls.NewListener(listener, s.TLSConfig), config.networkPolicy(), metrics)
 
 		log.Info().Msgf("SMTP server listening with TLS at %s", s.Addr)
-		if err := s.ListenAndServeTLS(); err != nil {
+		if err := s.Serve(listener); err != nil {
 			log.Fatal().Err(err).Msg("SMTP server failed with TLS")
 		}
 	} else {
 		s.AllowInsecureAuth = true
+		listener = newFilteredListener(listener, config.networkPolicy(), metrics)
+
 		log.Warn().Msg("SMTP server listening without TLS! DO NOT USE IN PRODUCTION!")
 		log.Info().Msgf("SMTP server listening on %s", s.Addr)
-		if err := s.ListenAndServe(); err != nil {
+		if err := s.Serve(listener); err != nil {
 			log.Fatal().Err(err).Msg("SMTP server failed")
 		}
 	}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-smtp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,6 +41,8 @@ func TestAuthPlain_Passes(t *testing.T) {
 		},
 	}
 
+	session.Config.Auth.AllowPlaintextPasswords = true
+
 	// Call the AuthPlain method
 	err := session.AuthPlain("test-username", "test-password")
 
@@ -59,6 +71,8 @@ func TestAuthPlain_Fails(t *testing.T) {
 		},
 	}
 
+	session.Config.Auth.AllowPlaintextPasswords = true
+
 	// Call the AuthPlain method
 	err := session.AuthPlain("test-username", "test-password-1")
 
@@ -133,8 +147,8 @@ func TestSession_Data(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	// Set the mock server URL as the NotifyClient hostname
-	session.Config.Notify.Hostname = mockServer.URL
+	// Use a NotifyClient for the mock server
+	session.Client = newNotifyClient(session.Config.Notify.ApiKey, mockServer.URL)
 
 	email := "" +
 		"To: <test@test.com>\r\n" +
@@ -288,7 +302,7 @@ func Test_startSmtpServer_withTls(t *testing.T) {
 			TlsKeyFile  string
 		}{
 			Hostname:    "localhost",
-			Port:        2525,
+			Port:        2526,
 			Username:    "test-username",
 			Password:    "test-password",
 			UseTLS:      true,
@@ -302,3 +316,896 @@ func Test_startSmtpServer_withTls(t *testing.T) {
 		startSmtpServer(&config)
 	}()
 }
+
+func TestSession_DataWithSpool(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	// Create a mock Session
+	session := Session{
+		Authenticated: true,
+		Email: &NotifyEmail{
+			TemplateId: "test-template-id",
+			Emails:     []string{"test@test.com"},
+		},
+		Config: &Config{},
+		Spool:  spool,
+	}
+
+	email := "" +
+		"To: <test@test.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"\r\n" +
+		"Test Body\r\n"
+
+	// Call the Data method
+	err = session.Data(strings.NewReader(email))
+
+	// Verify the client is told the queue ID
+	ids, _ := spool.List()
+	assert.Len(t, ids, 1)
+	assert.Equal(t, "OK: queued as "+ids[0], err.(*smtp.SMTPError).Message)
+	assert.Equal(t, 250, err.(*smtp.SMTPError).Code)
+
+	// Verify the spooled email
+	entry, err := spool.Load(ids[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "test-template-id", entry.TemplateId)
+	assert.Equal(t, "Test Subject", entry.Personalisation.Subject)
+	assert.Equal(t, []string{"test@test.com"}, entry.Emails)
+}
+
+func TestSession_DataReturnsSmtpError(t *testing.T) {
+	// Create a mock server that is rate limiting us
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, err := w.Write([]byte(`{"errors": [{"error": "RateLimitError", "message": "Exceeded rate limit"}], "status_code": 429}`))
+		assert.Nil(t, err)
+	}))
+	defer mockServer.Close()
+
+	// Create a mock Session
+	session := Session{
+		Authenticated: true,
+		Email: &NotifyEmail{
+			TemplateId: "test-template-id",
+			Emails:     []string{"test@test.com"},
+		},
+		Client: newNotifyClient("test-api-key", mockServer.URL),
+		Config: &Config{},
+	}
+
+	email := "" +
+		"To: <test@test.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"\r\n" +
+		"Test Body\r\n"
+
+	// Call the Data method
+	err := session.Data(strings.NewReader(email))
+
+	// Verify the client is told to try again later
+	smtpErr, ok := err.(*smtp.SMTPError)
+	assert.True(t, ok)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Equal(t, smtp.EnhancedCode{4, 7, 0}, smtpErr.EnhancedCode)
+	assert.Equal(t, "Notify API error 429: Exceeded rate limit (failed recipients: test@test.com)", smtpErr.Message)
+}
+
+func TestSession_DataLogsDroppedRecipients(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("busy@test.com")) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	session := Session{
+		Authenticated: true,
+		Email: &NotifyEmail{
+			TemplateId: "test-template-id",
+			Emails:     []string{"test@test.com", "busy@test.com"},
+		},
+		Client: newNotifyClient("test-api-key", mockServer.URL),
+		Config: &Config{},
+		Logger: &logger,
+	}
+
+	err := session.Data(strings.NewReader("To: <test@test.com>, <busy@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+
+	// The client won't retry, so without a spool the failed recipient is only logged
+	assert.Equal(t, 250, err.(*smtp.SMTPError).Code)
+	assert.Contains(t, logs.String(), `"event":"recipients_dropped","recipients":["busy@test.com"]`)
+}
+
+func TestSession_DataConvertsHtml(t *testing.T) {
+	var body interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requestPayload))
+		body = requestPayload["personalisation"].(map[string]interface{})["body"]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	htmlOnly := "" +
+		"To: <test@test.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<h1>Alert</h1><p>See <a href=\"https://example.com\">details</a></p>\r\n"
+
+	multipart := "" +
+		"To: <test@test.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=boundary\r\n" +
+		"\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Plain text\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p><b>HTML</b> text</p>\r\n" +
+		"--boundary--\r\n"
+
+	tests := []struct {
+		email      string
+		preferHtml bool
+		body       string
+	}{
+		{email: htmlOnly, preferHtml: false, body: "# Alert\n\nSee [details](https://example.com)"},
+		{email: multipart, preferHtml: false, body: "Plain text"},
+		{email: multipart, preferHtml: true, body: "**HTML** text"},
+	}
+
+	for _, test := range tests {
+		session := Session{
+			Authenticated: true,
+			Client:        newNotifyClient("test-api-key", mockServer.URL),
+			Config:        &Config{},
+			Email: &NotifyEmail{
+				TemplateId: "test-template-id",
+				Emails:     []string{"test@test.com"},
+			},
+		}
+		session.Config.Message.PreferHtml = test.preferHtml
+
+		err := session.Data(strings.NewReader(test.email))
+
+		assert.Nil(t, err)
+		assert.Equal(t, test.body, body)
+	}
+}
+
+func TestSession_DataSelectsTemplate(t *testing.T) {
+	var templateId interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requestPayload))
+		templateId = requestPayload["template_id"]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	newSession := func() *Session {
+		session := &Session{
+			Authenticated: true,
+			Client:        newNotifyClient("test-api-key", mockServer.URL),
+			Config:        &Config{},
+			Email: &NotifyEmail{
+				TemplateId: "00000000-0000-4000-8000-000000000000",
+				Emails:     []string{"test@test.com"},
+			},
+			Username: "grafana",
+		}
+		session.Config.Routing.Rules = []TemplateRule{{TemplateId: "11111111-1111-4111-8111-111111111111", Username: "grafana"}}
+		return session
+	}
+
+	// A rule matches the authenticated username
+	err := newSession().Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "11111111-1111-4111-8111-111111111111", templateId)
+
+	// The header overrides the rules
+	err = newSession().Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\nX-Notify-Template-Id: 22222222-2222-4222-8222-222222222222\r\n\r\nTest Body\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "22222222-2222-4222-8222-222222222222", templateId)
+
+	// An invalid header is rejected
+	err = newSession().Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\nX-Notify-Template-Id: invalid\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 554, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, "X-Notify-Template-Id must be a UUIDv4", err.(*smtp.SMTPError).Message)
+}
+
+func TestSession_DataAddsPersonalisationFromHeaders(t *testing.T) {
+	var personalisation map[string]interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requestPayload))
+		personalisation = requestPayload["personalisation"].(map[string]interface{})
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	session := Session{
+		Authenticated: true,
+		Client:        newNotifyClient("test-api-key", mockServer.URL),
+		Config:        &Config{},
+		Email: &NotifyEmail{
+			TemplateId: "test-template-id",
+			Emails:     []string{"test@test.com"},
+		},
+	}
+	session.Config.Message.PersonalisationKeyTransform = "snake"
+
+	email := "" +
+		"To: <test@test.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"X-Notify-Personalisation-Case-Number: 1234\r\n" +
+		"\r\n" +
+		"Test Body\r\n"
+
+	err := session.Data(strings.NewReader(email))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", personalisation["case_number"])
+	assert.Equal(t, "Test Subject", personalisation["subject"])
+}
+
+func TestSession_AuthPlainUsesTenant(t *testing.T) {
+	var apiKey string
+	var templateId interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestPayload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requestPayload))
+		apiKey = r.Header.Get("Authorization")
+		templateId = requestPayload["template_id"]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	tenant := &Tenant{
+		Username:   "grafana",
+		Password:   "grafana-password-1234",
+		ApiKey:     "grafana-api-key",
+		Hostname:   mockServer.URL,
+		TemplateId: "11111111-1111-4111-8111-111111111111",
+	}
+	client := newNotifyClient("test-api-key", mockServer.URL)
+
+	session := Session{
+		Client:  client,
+		Clients: map[string]*NotifyClient{"grafana": client.forTenant(tenant)},
+		Config:  &Config{},
+		Email: &NotifyEmail{
+			TemplateId: "00000000-0000-4000-8000-000000000000",
+		},
+	}
+	session.Config.Auth.Users = []*Tenant{tenant}
+	session.Config.Auth.AllowPlaintextPasswords = true
+
+	err := session.AuthPlain("grafana", "grafana-password-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, tenant, session.Tenant)
+
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ApiKey-v1 grafana-api-key", apiKey)
+	assert.Equal(t, "11111111-1111-4111-8111-111111111111", templateId)
+
+	// The tenant is kept for the next message in the session
+	session.Reset()
+	assert.Equal(t, "grafana", session.Email.Tenant)
+	assert.Equal(t, "11111111-1111-4111-8111-111111111111", session.Email.TemplateId)
+}
+
+func TestSession_SpoolsAsSingleUser(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	spool.Clients = map[string]*NotifyClient{}
+
+	// Without a users file only the tenants of the users file have a client
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	session := Session{
+		Client:  client,
+		Clients: spool.Clients,
+		Config:  &Config{},
+		Email: &NotifyEmail{
+			TemplateId: "test-template-id",
+		},
+		Spool: spool,
+	}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = "test-password"
+	session.Config.Auth.AllowPlaintextPasswords = true
+
+	assert.Nil(t, session.AuthPlain("test-username", "test-password"))
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 250, err.(*smtp.SMTPError).Code)
+
+	// The queued email is sent with the default client
+	spool.Deliver(client)
+	assert.Equal(t, 1, requests)
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestSession_RcptEnforcesTenantLimit(t *testing.T) {
+	session := Session{
+		Authenticated: true,
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+		Tenant: &Tenant{
+			Username: "grafana",
+			Limits:   TenantLimits{MaxRecipients: 1},
+		},
+	}
+
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+
+	err := session.Rcpt("test1@test.com", nil)
+	assert.Equal(t, 452, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, []string{"test@test.com"}, session.Email.Emails)
+
+	// Cc and Bcc addresses count towards the limit too
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nCc: <test1@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+}
+
+func TestAuthPlain_HashedPassword(t *testing.T) {
+	hash, err := hashPassword("test-password-1234")
+	assert.Nil(t, err)
+
+	session := Session{Config: &Config{}}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = hash
+
+	assert.NotNil(t, session.AuthPlain("test-username", "test-password-123"))
+	assert.False(t, session.Authenticated)
+
+	assert.Nil(t, session.AuthPlain("test-username", "test-password-1234"))
+	assert.True(t, session.Authenticated)
+}
+
+func TestAuthPlain_PlaintextNotAllowed(t *testing.T) {
+	session := Session{Config: &Config{}}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = "test-password-1234"
+
+	err := session.AuthPlain("test-username", "test-password-1234")
+	assert.Equal(t, "invalid username or password", err.Error())
+	assert.False(t, session.Authenticated)
+}
+
+func TestSession_Auth(t *testing.T) {
+	newSession := func() *Session {
+		session := &Session{Config: &Config{}, Email: &NotifyEmail{}}
+		session.Config.Smtp.Username = "test-username"
+		session.Config.Smtp.Password = "test-password-1234"
+		session.Config.Auth.AllowPlaintextPasswords = true
+		session.Config.Auth.Mechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-256"}
+		return session
+	}
+
+	// Mechanisms that aren't enabled are rejected
+	session := newSession()
+	session.Config.Auth.Mechanisms = []string{"PLAIN"}
+	assert.Equal(t, []string{"PLAIN"}, session.AuthMechanisms())
+	_, err := session.Auth("LOGIN")
+	assert.Equal(t, smtp.ErrAuthUnknownMechanism, err)
+
+	// PLAIN
+	session = newSession()
+	server, err := session.Auth("PLAIN")
+	assert.Nil(t, err)
+	_, done, err := server.Next([]byte("\x00test-username\x00test-password-1234"))
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.True(t, session.Authenticated)
+
+	// LOGIN
+	session = newSession()
+	server, err = session.Auth("LOGIN")
+	assert.Nil(t, err)
+	challenge, _, err := server.Next(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Username:", string(challenge))
+	_, _, err = server.Next([]byte("test-username"))
+	assert.Nil(t, err)
+	_, done, err = server.Next([]byte("test-password-1234"))
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.True(t, session.Authenticated)
+
+	// CRAM-MD5
+	session = newSession()
+	server, err = session.Auth("CRAM-MD5")
+	assert.Nil(t, err)
+	challenge, _, err = server.Next(nil)
+	assert.Nil(t, err)
+	mac := hmac.New(md5.New, []byte("test-password-1234"))
+	mac.Write(challenge)
+	_, _, err = server.Next([]byte("test-username " + hex.EncodeToString(mac.Sum(nil))))
+	assert.Nil(t, err)
+	assert.True(t, session.Authenticated)
+
+	// SCRAM-SHA-256
+	session = newSession()
+	server, err = session.Auth("SCRAM-SHA-256")
+	assert.Nil(t, err)
+	serverFirst, _, err := server.Next([]byte("n,,n=test-username,r=abc"))
+	assert.Nil(t, err)
+	clientFinal, serverFinal := scramClientFinal("test-password-1234", "n=test-username,r=abc", string(serverFirst))
+	challenge, _, err = server.Next([]byte(clientFinal))
+	assert.Nil(t, err)
+	assert.Equal(t, serverFinal, string(challenge))
+	assert.False(t, session.Authenticated)
+	_, done, err = server.Next([]byte{})
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.True(t, session.Authenticated)
+}
+
+func TestSession_AuthCramMd5NeedsPlaintextPassword(t *testing.T) {
+	hash, err := hashPasswordScram("test-password-1234")
+	assert.Nil(t, err)
+
+	session := &Session{Config: &Config{}, Email: &NotifyEmail{}}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = hash
+	session.Config.Auth.AllowPlaintextPasswords = true
+	session.Config.Auth.Mechanisms = []string{"CRAM-MD5", "SCRAM-SHA-256"}
+
+	// CRAM-MD5 can't be checked against a hash
+	server, err := session.Auth("CRAM-MD5")
+	assert.Nil(t, err)
+	challenge, _, err := server.Next(nil)
+	assert.Nil(t, err)
+	mac := hmac.New(md5.New, []byte("test-password-1234"))
+	mac.Write(challenge)
+	_, _, err = server.Next([]byte("test-username " + hex.EncodeToString(mac.Sum(nil))))
+	assert.Equal(t, "invalid username or password", err.Error())
+	assert.False(t, session.Authenticated)
+
+	// SCRAM-SHA-256 uses the stored keys
+	server, err = session.Auth("SCRAM-SHA-256")
+	assert.Nil(t, err)
+	serverFirst, _, err := server.Next([]byte("n,,n=test-username,r=abc"))
+	assert.Nil(t, err)
+	clientFinal, _ := scramClientFinal("test-password-1234", "n=test-username,r=abc", string(serverFirst))
+	_, _, err = server.Next([]byte(clientFinal))
+	assert.Nil(t, err)
+	_, _, err = server.Next([]byte{})
+	assert.Nil(t, err)
+	assert.True(t, session.Authenticated)
+}
+
+func TestSession_AuthLockout(t *testing.T) {
+	lockout, _ := newTestLockout()
+	newSession := func(ip string) *Session {
+		session := &Session{Config: &Config{}, Email: &NotifyEmail{}, Lockout: lockout, RemoteIp: ip}
+		session.Config.Smtp.Username = "test-username"
+		session.Config.Smtp.Password = "test-password-1234"
+		session.Config.Auth.AllowPlaintextPasswords = true
+		session.Config.Auth.Mechanisms = []string{"PLAIN"}
+		return session
+	}
+
+	// Two failures lock the username out, even with the right password
+	assert.Equal(t, "invalid username or password", newSession("10.0.0.1").AuthPlain("test-username", "wrong").Error())
+	assert.Equal(t, "invalid username or password", newSession("10.0.0.2").AuthPlain("test-username", "wrong").Error())
+
+	session := newSession("10.0.0.3")
+	err := session.AuthPlain("test-username", "test-password-1234")
+	assert.Equal(t, 535, err.(*smtp.SMTPError).Code)
+	assert.False(t, session.Authenticated)
+
+	// A third failure from the same IP locks it out before AUTH starts
+	newSession("10.0.0.1").AuthPlain("other-username", "wrong")
+	newSession("10.0.0.1").AuthPlain("another-username", "wrong")
+	_, err = newSession("10.0.0.1").Auth("PLAIN")
+	assert.Equal(t, 454, err.(*smtp.SMTPError).Code)
+
+	// Clearing the lockout lets the user back in
+	lockout.Unlock("username", "test-username")
+	session = newSession("10.0.0.3")
+	assert.Nil(t, session.AuthPlain("test-username", "test-password-1234"))
+	assert.True(t, session.Authenticated)
+}
+
+func TestSession_Relay(t *testing.T) {
+	tenant := &Tenant{
+		Username:   "scanners",
+		TemplateId: "11111111-1111-4111-8111-111111111111",
+		RelayCidrs: []string{"10.0.0.0/8"},
+	}
+
+	client := newNotifyClient("test-api-key", "http://localhost")
+	session := &Session{
+		Clients:  map[string]*NotifyClient{"scanners": client.forTenant(tenant)},
+		Config:   &Config{},
+		Email:    &NotifyEmail{},
+		RemoteIp: "10.1.2.3",
+	}
+	session.Config.Auth.Users = []*Tenant{tenant}
+	session.Config.Auth.AllowPlaintextPasswords = true
+	session.startRelay(tenant)
+
+	assert.True(t, session.Relay)
+	assert.True(t, session.Authenticated)
+	assert.Equal(t, "scanners", session.Username)
+	assert.Equal(t, "11111111-1111-4111-8111-111111111111", session.Email.TemplateId)
+	assert.Nil(t, session.Mail("scanner@test.com", nil))
+
+	// The session stays open for the next message
+	session.Reset()
+	assert.True(t, session.Authenticated)
+	assert.Equal(t, "scanners", session.Email.Tenant)
+
+	// The relay tenant has no password to sign in with
+	assert.Equal(t, "invalid username or password", (&Session{Config: session.Config}).AuthPlain("scanners", "").Error())
+}
+
+func TestSession_MailEnforcesAllowedSenders(t *testing.T) {
+	session := Session{
+		Authenticated: true,
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+		Tenant: &Tenant{
+			Username:       "grafana",
+			AllowedSenders: []string{"*@grafana.example.com"},
+		},
+	}
+
+	assert.Nil(t, session.Mail("noreply@grafana.example.com", nil))
+
+	err := session.Mail("ceo@example.com", nil)
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 1}, err.(*smtp.SMTPError).EnhancedCode)
+}
+
+func TestSession_DataChecksHeaderFrom(t *testing.T) {
+	session := Session{
+		Authenticated: true,
+		Config:        &Config{},
+		Email:         &NotifyEmail{Emails: []string{"test@test.com"}},
+		Tenant: &Tenant{
+			Username:        "grafana",
+			AllowedSenders:  []string{"*@grafana.example.com"},
+			CheckHeaderFrom: true,
+		},
+	}
+
+	err := session.Data(strings.NewReader("From: CEO <ceo@example.com>\r\nTo: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 1}, err.(*smtp.SMTPError).EnhancedCode)
+
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+}
+
+func TestSession_RcptEnforcesRecipientPolicy(t *testing.T) {
+	session := Session{
+		Authenticated: true,
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+		Tenant: &Tenant{
+			Username:   "staging",
+			Recipients: RecipientPolicy{Allow: []string{"*@cds-snc.ca"}},
+		},
+	}
+	session.Config.Recipients.Deny = []string{"blocked@cds-snc.ca"}
+
+	assert.Nil(t, session.Rcpt("someone@cds-snc.ca", nil))
+
+	// Each recipient is rejected on its own
+	err := session.Rcpt("someone@example.com", nil)
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 1}, err.(*smtp.SMTPError).EnhancedCode)
+	err = session.Rcpt("blocked@cds-snc.ca", nil)
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, []string{"someone@cds-snc.ca"}, session.Email.Emails)
+
+	// Cc and Bcc addresses go through the same policy
+	err = session.Data(strings.NewReader("To: <someone@cds-snc.ca>\r\nBcc: <someone@example.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, "Recipient address not allowed", err.(*smtp.SMTPError).Message)
+}
+
+func TestSession_RateLimits(t *testing.T) {
+	limiter, _ := newTestRateLimiter()
+	config := &Config{}
+	config.RateLimit.Messages.Ip = 1
+	config.RateLimit.Recipients.User = 5
+
+	newSession := func(tenant *Tenant) *Session {
+		return &Session{
+			Authenticated: true,
+			Config:        config,
+			Email:         &NotifyEmail{},
+			RateLimiter:   limiter,
+			RemoteIp:      "10.0.0.1",
+			Tenant:        tenant,
+			Username:      tenant.Username,
+		}
+	}
+
+	// One message a minute from the IP
+	session := newSession(&Tenant{Username: "grafana"})
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	err := session.Mail("noreply@example.com", nil)
+	assert.Equal(t, 451, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{4, 7, 1}, err.(*smtp.SMTPError).EnhancedCode)
+
+	// The tenant's own limit replaces the server's per user limit
+	session = newSession(&Tenant{Username: "jira", Limits: TenantLimits{RecipientsPerMinute: 2}})
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	assert.Nil(t, session.Rcpt("test1@test.com", nil))
+	err = session.Rcpt("test2@test.com", nil)
+	assert.Equal(t, 451, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, []string{"test@test.com", "test1@test.com"}, session.Email.Emails)
+
+	// Cc and Bcc addresses count as recipients
+	session = newSession(&Tenant{Username: "grafana"})
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nCc: <a@test.com>, <b@test.com>, <c@test.com>, <d@test.com>, <e@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 451, err.(*smtp.SMTPError).Code)
+
+	// More copies than the limit allows in a minute can never be sent
+	session = newSession(&Tenant{Username: "jira"})
+	err = session.Data(strings.NewReader("To: <test@test.com>\r\nCc: <a@test.com>, <b@test.com>, <c@test.com>\r\nBcc: <d@test.com>, <e@test.com>, <f@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n"))
+	assert.Equal(t, 552, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{5, 5, 3}, err.(*smtp.SMTPError).EnhancedCode)
+}
+
+func TestSession_DailyQuota(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "notification-id"}`))
+	}))
+	defer mockServer.Close()
+
+	quota, _ := newTestQuota(t)
+	client := newNotifyClient(testServiceApiKey, mockServer.URL)
+	client.Quota = quota
+	client.DailyQuota = 2
+
+	session := Session{
+		Authenticated: true,
+		Client:        client,
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+	}
+
+	// Every notification sent counts against the API key
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	assert.Nil(t, session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+	assert.Equal(t, 1, quota.Count(testServiceApiKey))
+
+	// Recipients over the quota are refused
+	session.Reset()
+	session.Authenticated = true
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	err := session.Rcpt("test1@test.com", nil)
+	assert.Equal(t, 452, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, smtp.EnhancedCode{4, 5, 3}, err.(*smtp.SMTPError).EnhancedCode)
+	assert.Nil(t, session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+
+	// New mail is refused once the quota is reached
+	session.Reset()
+	session.Authenticated = true
+	err = session.Mail("noreply@example.com", nil)
+	assert.Equal(t, 452, err.(*smtp.SMTPError).Code)
+	assert.Equal(t, "Daily sending quota reached, try again tomorrow", err.(*smtp.SMTPError).Message)
+}
+
+func TestSession_Metrics(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	metrics := newMetrics()
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	client.Metrics = metrics
+
+	session := Session{
+		Client:  client,
+		Config:  &Config{},
+		Email:   &NotifyEmail{},
+		Metrics: metrics,
+	}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = "test-password-1234"
+	session.Config.Auth.AllowPlaintextPasswords = true
+
+	assert.NotNil(t, session.AuthPlain("test-username", "wrong-password"))
+	assert.Nil(t, session.AuthPlain("test-username", "test-password-1234"))
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	assert.Nil(t, session.Data(strings.NewReader("To: <test@test.com>\r\nCc: <test1@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+
+	body := scrapeMetrics(t, metrics)
+	assert.Contains(t, body, `smtp_proxy_auth_total{result="failure"} 1`)
+	assert.Contains(t, body, `smtp_proxy_auth_total{result="success"} 1`)
+	assert.Contains(t, body, `smtp_proxy_messages_total{result="accepted"} 1`)
+	assert.Contains(t, body, "smtp_proxy_recipients_total 2\n")
+	assert.Contains(t, body, `smtp_proxy_notify_request_duration_seconds_count{status_code="201"} 2`)
+}
+
+func TestBackend_NewSessionId(t *testing.T) {
+	backend := &Backend{Config: &Config{}}
+
+	first, err := backend.NewSession(nil)
+	assert.Nil(t, err)
+	second, err := backend.NewSession(nil)
+	assert.Nil(t, err)
+
+	assert.Len(t, first.(*Session).Id, 16)
+	assert.NotEqual(t, first.(*Session).Id, second.(*Session).Id)
+}
+
+func TestSession_CorrelationIds(t *testing.T) {
+	var requestIds []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIds = append(requestIds, r.Header.Get("X-Request-Id"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs).With().Str("session_id", "0123456789abcdef").Str("remote_ip", "10.0.0.1").Logger()
+
+	session := Session{
+		Client: newNotifyClient("test-api-key", mockServer.URL),
+		Config: &Config{},
+		Email:  &NotifyEmail{},
+		Id:     "0123456789abcdef",
+		Logger: &logger,
+	}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = "test-password-1234"
+	session.Config.Auth.AllowPlaintextPasswords = true
+
+	assert.Nil(t, session.AuthPlain("test-username", "test-password-1234"))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, session.Mail("noreply@example.com", nil))
+		assert.Nil(t, session.Rcpt("test@test.com", nil))
+		assert.Nil(t, session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+		session.Reset()
+		session.Authenticated = true
+	}
+
+	// Each transaction is tagged with its own request ID
+	assert.Equal(t, []string{"0123456789abcdef-1", "0123456789abcdef-2"}, requestIds)
+
+	// Every log line of the second transaction, including the Notify client's, carries
+	// the session, username and transaction
+	sent := 0
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "0123456789abcdef", entry["session_id"])
+		assert.Equal(t, "10.0.0.1", entry["remote_ip"])
+		assert.Equal(t, "test-username", entry["username"])
+		if strings.HasPrefix(entry["message"].(string), "Sent email to") {
+			sent++
+			assert.Equal(t, float64(sent), entry["transaction"])
+		}
+	}
+	assert.Equal(t, 2, sent)
+}
+
+func TestSession_RedactsLogs(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	logRedactor = newRedactor(redactionMask, "")
+	t.Cleanup(func() { logRedactor = nil })
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs).Level(zerolog.DebugLevel)
+
+	session := Session{
+		Authenticated: true,
+		Client:        newNotifyClient("test-api-key", mockServer.URL),
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+		Logger:        &logger,
+	}
+
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("jane.doe@test.com", nil))
+	assert.Nil(t, session.Data(strings.NewReader("To: <jane.doe@test.com>\r\nCc: <john.doe@test.com>\r\nSubject: Your passport application\r\n\r\nTest Body\r\n")))
+
+	assert.NotContains(t, logs.String(), "noreply@")
+	assert.NotContains(t, logs.String(), "jane.doe")
+	assert.NotContains(t, logs.String(), "john.doe")
+	assert.NotContains(t, logs.String(), "passport")
+	assert.Contains(t, logs.String(), "Mail from: n***@example.com")
+	assert.Contains(t, logs.String(), "Sent email to j***@test.com")
+	assert.Contains(t, logs.String(), `"subject":"[redacted]"`)
+}
+
+func TestSpool_DeliverRedactsLogs(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer mockServer.Close()
+
+	logRedactor = newRedactor(redactionMask, "")
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() {
+		logRedactor = nil
+		log.Logger = logger
+	})
+
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	id, err := spool.Enqueue(&NotifyEmail{Emails: []string{"secret.person@example.com"}, TemplateId: "test-template-id"})
+	assert.Nil(t, err)
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	assert.Contains(t, logs.String(), "Error delivering spooled email")
+	assert.Contains(t, logs.String(), "s***@example.com")
+	assert.NotContains(t, logs.String(), "secret.person")
+
+	// The spool keeps the failed recipients for whoever looks into it
+	data, err := os.ReadFile(filepath.Join(spool.Dir, "failed", id+".json"))
+	assert.Nil(t, err)
+	var entry SpooledEmail
+	assert.Nil(t, json.Unmarshal(data, &entry))
+	assert.Contains(t, entry.LastError, "secret.person@example.com")
+}
+
+func TestSession_RedactsUsernames(t *testing.T) {
+	logRedactor = newRedactor(redactionMask, "")
+	t.Cleanup(func() { logRedactor = nil })
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+
+	session := Session{
+		Config:  &Config{},
+		Email:   &NotifyEmail{},
+		Lockout: newLockout(LockoutPolicy{}, LockoutPolicy{MaxFailures: 1, Window: time.Minute, Duration: time.Minute}),
+		Logger:  &logger,
+	}
+	session.Config.Smtp.Username = "jane.doe@example.com"
+	session.Config.Smtp.Password = "test-password-1234"
+	session.Config.Auth.AllowPlaintextPasswords = true
+
+	assert.NotNil(t, session.AuthPlain("jane.doe@example.com", "wrong-password"))
+	assert.NotNil(t, session.AuthPlain("jane.doe@example.com", "test-password-1234"))
+
+	assert.Contains(t, logs.String(), "Invalid username or password: j***@example.com")
+	assert.Contains(t, logs.String(), `"username":"j***@example.com"`)
+	assert.Contains(t, logs.String(), "Rejected login for locked out user j***@example.com")
+	assert.NotContains(t, logs.String(), "jane.doe")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// The longest Notify message we copy into an SMTP reply
+const maxReplyMessageLength = 200
+
+// The most failed recipients we list in an SMTP reply
+const maxReplyRecipients = 5
+
+// toSmtpError maps a failure to send an email to an SMTP reply so that clients
+// can tell a temporary failure they should retry from a permanent one
+func toSmtpError(err error) *smtp.SMTPError {
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		recipients := formatFailedRecipients(deliveryErr.Failed)
+
+		// The email was sent to some recipients so the client must not retry it,
+		// otherwise those recipients would get it twice
+		if deliveryErr.Sent > 0 {
+			return &smtp.SMTPError{
+				Code:         250,
+				EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+				Message:      fmt.Sprintf("OK: sent to %d of %d recipients, failed recipients: %s", deliveryErr.Sent, deliveryErr.Total, recipients),
+			}
+		}
+
+		reply := *toSmtpError(deliveryErr.cause())
+		reply.Message = fmt.Sprintf("%s (failed recipients: %s)", reply.Message, recipients)
+		return &reply
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+
+	var notifyErr *NotifyError
+	if !errors.As(err, &notifyErr) {
+		// Network errors and timeouts mean we never got an answer from Notify
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+			Message:      "Notify API is unavailable, try again later",
+		}
+	}
+
+	message := sanitizeReplyMessage(notifyErr.Message)
+	if message == "" {
+		message = http.StatusText(notifyErr.StatusCode)
+	}
+	message = fmt.Sprintf("Notify API error %d: %s", notifyErr.StatusCode, message)
+
+	switch {
+	case notifyErr.StatusCode == http.StatusTooManyRequests:
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      message,
+		}
+	case notifyErr.StatusCode >= 500:
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      message,
+		}
+	case notifyErr.StatusCode == http.StatusForbidden || notifyErr.StatusCode == http.StatusUnauthorized:
+		return &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      message,
+		}
+	case notifyErr.StatusCode == http.StatusBadRequest && strings.Contains(notifyErr.Message, "email_address"):
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      message,
+		}
+	case notifyErr.StatusCode == http.StatusBadRequest:
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      message,
+		}
+	default:
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+			Message:      message,
+		}
+	}
+}
+
+// sanitizeReplyMessage makes a message safe to send in an SMTP reply by keeping
+// printable ASCII on a single line and limiting its length
+func sanitizeReplyMessage(message string) string {
+	var b strings.Builder
+	for _, r := range message {
+		switch {
+		case r == '\r' || r == '\n' || r == '\t':
+			b.WriteRune(' ')
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		}
+	}
+
+	sanitized := strings.Join(strings.Fields(b.String()), " ")
+	if len(sanitized) > maxReplyMessageLength {
+		sanitized = sanitized[:maxReplyMessageLength-3] + "..."
+	}
+
+	return sanitized
+}
+
+func formatFailedRecipients(failed []RecipientResult) string {
+	recipients := []string{}
+	for i, result := range failed {
+		if i == maxReplyRecipients {
+			recipients = append(recipients, fmt.Sprintf("and %d more", len(failed)-maxReplyRecipients))
+			break
+		}
+		recipients = append(recipients, sanitizeReplyMessage(result.EmailAddress))
+	}
+	return strings.Join(recipients, ", ")
+}
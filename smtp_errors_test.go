@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToSmtpError(t *testing.T) {
+	tests := []struct {
+		err          error
+		code         int
+		enhancedCode smtp.EnhancedCode
+		message      string
+	}{
+		{
+			err:          &NotifyError{StatusCode: 429, Message: "Exceeded rate limit for key type LIVE of 1000 requests per 60 seconds"},
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 7, 0},
+			message:      "Notify API error 429: Exceeded rate limit for key type LIVE of 1000 requests per 60 seconds",
+		},
+		{
+			err:          &NotifyError{StatusCode: 502},
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 3, 0},
+			message:      "Notify API error 502: Bad Gateway",
+		},
+		{
+			err:          &NotifyError{StatusCode: 400, Message: "email_address Not a valid email address"},
+			code:         550,
+			enhancedCode: smtp.EnhancedCode{5, 1, 3},
+			message:      "Notify API error 400: email_address Not a valid email address",
+		},
+		{
+			err:          &NotifyError{StatusCode: 400, Message: "Missing personalisation: name"},
+			code:         554,
+			enhancedCode: smtp.EnhancedCode{5, 6, 0},
+			message:      "Notify API error 400: Missing personalisation: name",
+		},
+		{
+			err:          &NotifyError{StatusCode: 403, Message: "Invalid token: API key not found"},
+			code:         535,
+			enhancedCode: smtp.EnhancedCode{5, 7, 8},
+			message:      "Notify API error 403: Invalid token: API key not found",
+		},
+		{
+			err:          &NotifyError{StatusCode: 404},
+			code:         554,
+			enhancedCode: smtp.EnhancedCode{5, 0, 0},
+			message:      "Notify API error 404: Not Found",
+		},
+		{
+			err:          errors.New("dial tcp: connection refused"),
+			code:         451,
+			enhancedCode: smtp.EnhancedCode{4, 4, 1},
+			message:      "Notify API is unavailable, try again later",
+		},
+	}
+
+	for _, test := range tests {
+		smtpErr := toSmtpError(test.err)
+		assert.Equal(t, test.code, smtpErr.Code)
+		assert.Equal(t, test.enhancedCode, smtpErr.EnhancedCode)
+		assert.Equal(t, test.message, smtpErr.Message)
+	}
+}
+
+func TestSanitizeReplyMessage(t *testing.T) {
+	assert.Equal(t, "line one line two", sanitizeReplyMessage("line one\r\nline two"))
+	assert.Equal(t, "caf", sanitizeReplyMessage("café"))
+	assert.Equal(t, "a b", sanitizeReplyMessage("  a \t b  "))
+	assert.Equal(t, 200, len(sanitizeReplyMessage(strings.Repeat("a", 500))))
+}
+
+func TestToSmtpError_DeliveryError(t *testing.T) {
+	// Nothing was sent so the client is told why
+	smtpErr := toSmtpError(&DeliveryError{
+		Failed: []RecipientResult{
+			{EmailAddress: "test@test.com", Permanent: true, err: &NotifyError{StatusCode: 400, Message: "Bad request"}},
+			{EmailAddress: "test1@test.com", err: &NotifyError{StatusCode: 500}},
+		},
+		Total: 2,
+	})
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Equal(t, "Notify API error 500: Internal Server Error (failed recipients: test@test.com, test1@test.com)", smtpErr.Message)
+
+	// Some recipients were sent the email so the client must not retry
+	smtpErr = toSmtpError(&DeliveryError{
+		Failed: []RecipientResult{
+			{EmailAddress: "test1@test.com", err: &NotifyError{StatusCode: 500}},
+		},
+		Sent:  1,
+		Total: 2,
+	})
+	assert.Equal(t, 250, smtpErr.Code)
+	assert.Equal(t, "OK: sent to 1 of 2 recipients, failed recipients: test1@test.com", smtpErr.Message)
+}
+
+func TestFormatFailedRecipients(t *testing.T) {
+	failed := []RecipientResult{}
+	for i := 0; i < 7; i++ {
+		failed = append(failed, RecipientResult{EmailAddress: fmt.Sprintf("test%d@test.com", i)})
+	}
+
+	assert.Equal(t, "test0@test.com, test1@test.com, test2@test.com, test3@test.com, test4@test.com, and 2 more", formatFailedRecipients(failed))
+}
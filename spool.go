@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Spool struct {
+	Dir    string
+	MaxAge time.Duration
+
+	// Clients of the tenants, keyed by username
+	Clients map[string]*NotifyClient
+}
+
+type SpooledEmail struct {
+	Id              string       `json:"id"`
+	Attachments     []Attachment `json:"attachments"`
+	Emails          []string     `json:"emails"`
+	Personalisation Body         `json:"personalisation"`
+	Tenant          string       `json:"tenant,omitempty"`
+	TemplateId      string       `json:"template_id"`
+	RequestId       string       `json:"request_id,omitempty"`
+
+	// Trace context of the session that queued the email, so its delivery can be
+	// linked back to it
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	QueuedAt  time.Time `json:"queued_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// Results are kept between attempts so recipients are only sent the email once
+	Results []RecipientResult `json:"results,omitempty"`
+}
+
+func newSpool(dir string, maxAge time.Duration) (*Spool, error) {
+	// Failed messages are kept in a subdirectory so they are never picked up again
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0700); err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		Dir:    dir,
+		MaxAge: maxAge,
+	}, nil
+}
+
+func newQueueId() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	// Prefix with the time so that sorting the IDs gives us the queue order
+	return fmt.Sprintf("%d-%s", time.Now().UTC().UnixNano(), hex.EncodeToString(random)), nil
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+// Enqueue writes the email to disk and returns its queue ID
+func (s *Spool) Enqueue(email *NotifyEmail) (string, error) {
+	id, err := newQueueId()
+	if err != nil {
+		return "", err
+	}
+
+	entry := &SpooledEmail{
+		Id:              id,
+		Attachments:     email.Attachments,
+		Emails:          email.Emails,
+		Personalisation: email.Personalisation,
+		Tenant:          email.Tenant,
+		TemplateId:      email.TemplateId,
+		RequestId:       email.RequestId,
+		TraceContext:    injectTraceContext(email.context()),
+		QueuedAt:        time.Now().UTC(),
+	}
+
+	if err := s.Save(entry); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Save writes the entry to a temporary file and renames it into place so that
+// a crash can never leave a partially written message in the spool
+func (s *Spool) Save(entry *SpooledEmail) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(entry.Id))
+}
+
+func (s *Spool) Load(id string) (*SpooledEmail, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry SpooledEmail
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (s *Spool) Remove(id string) error {
+	return os.Remove(s.path(id))
+}
+
+// Fail moves the entry out of the queue so it is kept for inspection but never retried
+func (s *Spool) Fail(id string) error {
+	return os.Rename(s.path(id), filepath.Join(s.Dir, "failed", id+".json"))
+}
+
+// List returns the queue IDs of all spooled emails, oldest first
+func (s *Spool) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Deliver makes one pass over the spool and sends every queued email to Notify,
+// using the default client for emails that don't belong to a tenant
+func (s *Spool) Deliver(client *NotifyClient) {
+	ids, err := s.List()
+	if err != nil {
+		log.Error().Msgf("Error listing spool: %s", err)
+		return
+	}
+
+	for _, id := range ids {
+		entry, err := s.Load(id)
+		if err != nil {
+			log.Error().Msgf("Error loading spooled email %s: %s", id, err)
+			continue
+		}
+
+		email := &NotifyEmail{
+			Attachments:     entry.Attachments,
+			Emails:          entry.Emails,
+			Personalisation: entry.Personalisation,
+			Results:         entry.Results,
+			Tenant:          entry.Tenant,
+			TemplateId:      entry.TemplateId,
+			RequestId:       entry.RequestId,
+		}
+
+		// Log with the request ID of the session that queued the email
+		logger := log.With().Str("queue_id", id).Str("request_id", entry.RequestId).Logger()
+		email.Logger = &logger
+
+		// Send as the tenant that queued the email. A tenant that has since been removed
+		// must not have its email sent with another service's API key.
+		tenantClient := client
+		if entry.Tenant != "" {
+			c, ok := s.Clients[entry.Tenant]
+			if !ok {
+				logger.Error().Msgf("Spooled email %s belongs to unknown user %s, giving up", id, redactUsername(entry.Tenant))
+				entry.LastError = fmt.Sprintf("unknown user %s", entry.Tenant)
+				err := s.Save(entry)
+				if err == nil {
+					err = s.Fail(id)
+				}
+				if err != nil {
+					logger.Error().Msgf("Error moving spooled email %s to failed: %s", id, err)
+				}
+				continue
+			}
+			tenantClient = c
+		}
+
+		// Deliveries happen long after the session ended, so they start their own trace
+		// linked to the session's
+		ctx, span := tracer().Start(context.Background(), "spool.deliver",
+			trace.WithLinks(trace.LinkFromContext(extractTraceContext(entry.TraceContext))),
+			trace.WithAttributes(
+				attribute.String("spool.queue_id", id),
+				attribute.String("smtp.request_id", entry.RequestId),
+				attribute.Int("spool.attempt", entry.Attempts+1),
+			),
+		)
+		email.Context = ctx
+		err = sendEmail(tenantClient, email)
+		endSpan(span, err)
+
+		if err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			entry.Results = email.Results
+			// The error lists the failed recipients, it is saved as is but redacted in the logs
+			logger.Error().Msgf("Error delivering spooled email %s (attempt %d): %s", id, entry.Attempts, redactText(err.Error()))
+
+			// Only temporary failures are worth another attempt
+			giveUp := false
+			var deliveryErr *DeliveryError
+			if errors.As(err, &deliveryErr) && !deliveryErr.Temporary() {
+				logger.Error().Msgf("Spooled email %s failed permanently, giving up", id)
+				giveUp = true
+			} else if s.MaxAge > 0 && time.Since(entry.QueuedAt) > s.MaxAge {
+				logger.Error().Msgf("Spooled email %s is older than %s, giving up", id, s.MaxAge)
+				giveUp = true
+			}
+
+			if giveUp {
+				err := s.Save(entry)
+				if err == nil {
+					err = s.Fail(id)
+				}
+				if err != nil {
+					logger.Error().Msgf("Error moving spooled email %s to failed: %s", id, err)
+				}
+				continue
+			}
+
+			if err := s.Save(entry); err != nil {
+				logger.Error().Msgf("Error updating spooled email %s: %s", id, err)
+			}
+			continue
+		}
+
+		logger.Info().Msgf("Delivered spooled email %s", id)
+		if err := s.Remove(id); err != nil {
+			logger.Error().Msgf("Error removing spooled email %s: %s", id, err)
+		}
+	}
+}
+
+func startDeliveryWorker(spool *Spool, client *NotifyClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info().Msgf("Delivery worker draining spool at %s every %s", spool.Dir, interval)
+	for {
+		spool.Deliver(client)
+		<-ticker.C
+	}
+}
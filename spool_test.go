@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool_EnqueueAndLoad(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	email := &NotifyEmail{
+		TemplateId: "test-template-id",
+		Personalisation: Body{
+			Subject: "Test Subject",
+			Body:    "Test Body",
+		},
+		Attachments: []Attachment{
+			{
+				File:          "test-file",
+				Filename:      "test-filename",
+				SendingMethod: "attach",
+			},
+		},
+		Emails: []string{"test@test.com", "test1@test.com"},
+	}
+
+	id, err := spool.Enqueue(email)
+	assert.Nil(t, err)
+
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	assert.Equal(t, id, entry.Id)
+	assert.Equal(t, email.TemplateId, entry.TemplateId)
+	assert.Equal(t, email.Personalisation, entry.Personalisation)
+	assert.Equal(t, email.Attachments, entry.Attachments)
+	assert.Equal(t, email.Emails, entry.Emails)
+	assert.Equal(t, 0, entry.Attempts)
+}
+
+func TestSpool_ListIsOrderedAndSkipsTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newSpool(dir, time.Hour)
+	assert.Nil(t, err)
+
+	first, err := spool.Enqueue(&NotifyEmail{Emails: []string{"test@test.com"}})
+	assert.Nil(t, err)
+	second, err := spool.Enqueue(&NotifyEmail{Emails: []string{"test@test.com"}})
+	assert.Nil(t, err)
+
+	// A partially written file from a crash should be ignored
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("{"), 0600))
+
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first, second}, ids)
+}
+
+func TestSpool_DeliverRemovesSentEmails(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	_, err = spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com"},
+	})
+	assert.Nil(t, err)
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, 1, requests)
+}
+
+func TestSpool_DeliverKeepsFailedEmails(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	id, err := spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com"},
+	})
+	assert.Nil(t, err)
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, entry.Attempts)
+	assert.Equal(t, "failed to send to 1 of 1 recipients: test@test.com: unexpected status code: 500", entry.LastError)
+}
+
+func TestSpool_DeliverOnlyRetriesFailedRecipients(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	requests := map[string]int{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+
+		address := payload["email_address"].(string)
+		requests[address]++
+
+		// The second recipient fails on the first pass only
+		if address == "test1@test.com" && requests[address] == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	id, err := spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com", "test1@test.com"},
+	})
+	assert.Nil(t, err)
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+
+	spool.Deliver(client)
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	assert.True(t, entry.Results[0].Sent)
+	assert.False(t, entry.Results[1].Sent)
+
+	spool.Deliver(client)
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, map[string]int{"test@test.com": 1, "test1@test.com": 2}, requests)
+}
+
+func TestSpool_DeliverGivesUpOnPermanentFailures(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newSpool(dir, time.Hour)
+	assert.Nil(t, err)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer mockServer.Close()
+
+	id, err := spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com"},
+	})
+	assert.Nil(t, err)
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.FileExists(t, filepath.Join(dir, "failed", id+".json"))
+}
+
+func TestSpool_DeliverGivesUpOnExpiredEmails(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newSpool(dir, time.Hour)
+	assert.Nil(t, err)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	id, err := spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com"},
+	})
+	assert.Nil(t, err)
+
+	// Pretend the email has been sitting in the queue for too long
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	entry.QueuedAt = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, spool.Save(entry))
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.FileExists(t, filepath.Join(dir, "failed", id+".json"))
+}
+
+func TestSpool_DeliverUsesTenantClient(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	apiKeys := []string{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKeys = append(apiKeys, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	client := newNotifyClient("test-api-key", mockServer.URL)
+	spool.Clients = map[string]*NotifyClient{
+		"grafana": client.forTenant(&Tenant{ApiKey: "grafana-api-key", Hostname: mockServer.URL}),
+	}
+
+	_, err = spool.Enqueue(&NotifyEmail{
+		Emails:     []string{"test@test.com"},
+		Tenant:     "grafana",
+		TemplateId: "test-template-id",
+	})
+	assert.Nil(t, err)
+	_, err = spool.Enqueue(&NotifyEmail{
+		Emails:     []string{"test@test.com"},
+		TemplateId: "test-template-id",
+	})
+	assert.Nil(t, err)
+
+	spool.Deliver(client)
+
+	assert.Equal(t, []string{"ApiKey-v1 grafana-api-key", "ApiKey-v1 test-api-key"}, apiKeys)
+}
+
+func TestSpool_DeliverFailsUnknownTenant(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	// The tenant was removed from the users file after the email was queued
+	id, err := spool.Enqueue(&NotifyEmail{
+		Emails:     []string{"test@test.com"},
+		Tenant:     "grafana",
+		TemplateId: "test-template-id",
+	})
+	assert.Nil(t, err)
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	assert.Equal(t, 0, requests)
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	data, err := os.ReadFile(filepath.Join(spool.Dir, "failed", id+".json"))
+	assert.Nil(t, err)
+	var entry SpooledEmail
+	assert.Nil(t, json.Unmarshal(data, &entry))
+	assert.Equal(t, "unknown user grafana", entry.LastError)
+}
+
+func TestSpool_DeliverKeepsEmailsOverTheDailyQuota(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	quota, _ := newTestQuota(t)
+	client := newNotifyClient(testServiceApiKey, mockServer.URL)
+	client.Quota = quota
+	client.DailyQuota = 2
+
+	// Both emails were accepted before either was sent
+	_, err = spool.Enqueue(&NotifyEmail{Emails: []string{"test1@test.com", "test2@test.com"}, TemplateId: "test-template-id"})
+	assert.Nil(t, err)
+	id, err := spool.Enqueue(&NotifyEmail{Emails: []string{"test3@test.com"}, TemplateId: "test-template-id"})
+	assert.Nil(t, err)
+
+	spool.Deliver(client)
+
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 2, quota.Count(testServiceApiKey))
+	ids, err := spool.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, ids)
+
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	assert.Equal(t, errQuotaReached.Error(), entry.Results[0].Error)
+	assert.False(t, entry.Results[0].Permanent)
+}
+
+func TestSpool_DeliverKeepsRequestId(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+
+	var requestId string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId = r.Header.Get("X-Request-Id")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	id, err := spool.Enqueue(&NotifyEmail{
+		TemplateId: "test-template-id",
+		Emails:     []string{"test@test.com"},
+		RequestId:  "0123456789abcdef-1",
+	})
+	assert.Nil(t, err)
+
+	entry, err := spool.Load(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef-1", entry.RequestId)
+
+	// The email is sent with the request ID of the session that queued it
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+	assert.Equal(t, "0123456789abcdef-1", requestId)
+}
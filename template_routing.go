@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Header a client can set to pick the template of a message
+const templateIdHeader = "X-Notify-Template-Id"
+
+var uuidV4Regex = regexp.MustCompile(`^[0-9a-fA-F]{8}\-[0-9a-fA-F]{4}\-4[0-9a-fA-F]{3}\-[89abAB][0-9a-fA-F]{3}\-[0-9a-fA-F]{12}$`)
+
+// TemplateRule picks a template for the messages that match all of its conditions
+type TemplateRule struct {
+	TemplateId string `yaml:"template_id"`
+
+	// Exact address or a domain wildcard such as *@cds-snc.ca
+	Sender string `yaml:"sender"`
+
+	// Matches if any recipient is at this domain
+	RecipientDomain string `yaml:"recipient_domain"`
+
+	// Regular expressions matched against the subject and a header value. A header
+	// name without a value matches any message that has the header.
+	Subject     string `yaml:"subject"`
+	HeaderName  string `yaml:"header_name"`
+	HeaderValue string `yaml:"header_value"`
+
+	// Authenticated SMTP username
+	Username string `yaml:"username"`
+
+	subjectRegex     *regexp.Regexp
+	headerValueRegex *regexp.Regexp
+}
+
+// TemplateMessage holds what a rule can match on
+type TemplateMessage struct {
+	From       string
+	Header     mail.Header
+	Recipients []string
+	Subject    string
+	Username   string
+}
+
+func isUUIDv4(id string) bool {
+	return uuidV4Regex.MatchString(id)
+}
+
+// loadTemplateRules reads the rules from a YAML file and validates them
+func loadTemplateRules(path string) ([]TemplateRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules []TemplateRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	for i := range file.Rules {
+		if err := file.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("template rule %d: %s", i+1, err)
+		}
+	}
+
+	return file.Rules, nil
+}
+
+func (rule *TemplateRule) compile() error {
+	if !isUUIDv4(rule.TemplateId) {
+		return errors.New("template ID must be a UUIDv4")
+	}
+
+	if rule.Sender == "" && rule.RecipientDomain == "" && rule.Subject == "" && rule.HeaderName == "" && rule.Username == "" {
+		return errors.New("at least one condition must be specified")
+	}
+
+	if rule.Subject != "" {
+		r, err := regexp.Compile(rule.Subject)
+		if err != nil {
+			return fmt.Errorf("invalid subject: %s", err)
+		}
+		rule.subjectRegex = r
+	}
+
+	if rule.HeaderValue != "" && rule.HeaderName == "" {
+		return errors.New("header value needs a header name")
+	}
+
+	if rule.HeaderValue != "" {
+		r, err := regexp.Compile(rule.HeaderValue)
+		if err != nil {
+			return fmt.Errorf("invalid header value: %s", err)
+		}
+		rule.headerValueRegex = r
+	}
+
+	return nil
+}
+
+func (rule *TemplateRule) matches(message *TemplateMessage) bool {
+	if rule.Sender != "" && !matchAddress(rule.Sender, message.From) {
+		return false
+	}
+
+	if rule.RecipientDomain != "" {
+		found := false
+		for _, recipient := range message.Recipients {
+			if strings.EqualFold(addressDomain(recipient), rule.RecipientDomain) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.subjectRegex != nil && !rule.subjectRegex.MatchString(message.Subject) {
+		return false
+	}
+
+	// A missing header reads as an empty value, which a value pattern could match
+	if rule.HeaderName != "" {
+		if _, ok := message.Header[textproto.CanonicalMIMEHeaderKey(rule.HeaderName)]; !ok {
+			return false
+		}
+		if rule.headerValueRegex != nil && !rule.headerValueRegex.MatchString(message.Header.Get(rule.HeaderName)) {
+			return false
+		}
+	}
+
+	if rule.Username != "" && rule.Username != message.Username {
+		return false
+	}
+
+	return true
+}
+
+// selectTemplate returns the template ID set in the message header, or the first rule
+// that matches the message, or the default when nothing matches
+func selectTemplate(rules []TemplateRule, defaultId string, message *TemplateMessage) (string, error) {
+	if id := strings.TrimSpace(message.Header.Get(templateIdHeader)); id != "" {
+		if !isUUIDv4(id) {
+			return "", fmt.Errorf("%s must be a UUIDv4", templateIdHeader)
+		}
+		return id, nil
+	}
+
+	for i := range rules {
+		if rules[i].matches(message) {
+			return rules[i].TemplateId, nil
+		}
+	}
+
+	return defaultId, nil
+}
+
+// matchAddress matches an address against an exact address or a *@domain wildcard
+func matchAddress(pattern string, address string) bool {
+	if domain, ok := strings.CutPrefix(pattern, "*@"); ok {
+		return strings.EqualFold(addressDomain(address), domain)
+	}
+	return strings.EqualFold(pattern, address)
+}
+
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
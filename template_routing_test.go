@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	defaultTemplateId = "00000000-0000-4000-8000-000000000000"
+	frenchTemplateId  = "11111111-1111-4111-8111-111111111111"
+	grafanaTemplateId = "22222222-2222-4222-8222-222222222222"
+	jiraTemplateId    = "33333333-3333-4333-8333-333333333333"
+	headerTemplateId  = "44444444-4444-4444-8444-444444444444"
+	alertTemplateId   = "55555555-5555-4555-8555-555555555555"
+)
+
+func writeTemplateRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(rules), 0600))
+	return path
+}
+
+func TestLoadTemplateRules(t *testing.T) {
+	path := writeTemplateRules(t, `
+rules:
+  - template_id: 11111111-1111-4111-8111-111111111111
+    subject: "^\\[FR\\]"
+  - template_id: 22222222-2222-4222-8222-222222222222
+    sender: "*@grafana.cdssandbox.xyz"
+    recipient_domain: cds-snc.ca
+  - template_id: 33333333-3333-4333-8333-333333333333
+    username: jira
+    header_name: X-Jira-Project
+    header_value: "^OPS$"
+`)
+
+	rules, err := loadTemplateRules(path)
+	assert.Nil(t, err)
+	assert.Len(t, rules, 3)
+	assert.Equal(t, frenchTemplateId, rules[0].TemplateId)
+	assert.Equal(t, "*@grafana.cdssandbox.xyz", rules[1].Sender)
+	assert.Equal(t, "X-Jira-Project", rules[2].HeaderName)
+}
+
+func TestLoadTemplateRules_Invalid(t *testing.T) {
+	_, err := loadTemplateRules(writeTemplateRules(t, `
+rules:
+  - template_id: invalid
+    subject: test
+`))
+	assert.Equal(t, "template rule 1: template ID must be a UUIDv4", err.Error())
+
+	_, err = loadTemplateRules(writeTemplateRules(t, `
+rules:
+  - template_id: 11111111-1111-4111-8111-111111111111
+`))
+	assert.Equal(t, "template rule 1: at least one condition must be specified", err.Error())
+
+	_, err = loadTemplateRules(writeTemplateRules(t, `
+rules:
+  - template_id: 11111111-1111-4111-8111-111111111111
+    subject: "("
+`))
+	assert.Contains(t, err.Error(), "template rule 1: invalid subject")
+
+	_, err = loadTemplateRules(writeTemplateRules(t, `
+rules:
+  - template_id: 11111111-1111-4111-8111-111111111111
+    username: jira
+    header_value: "^OPS$"
+`))
+	assert.Equal(t, "template rule 1: header value needs a header name", err.Error())
+
+	_, err = loadTemplateRules(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NotNil(t, err)
+}
+
+func TestSelectTemplate(t *testing.T) {
+	rules, err := loadTemplateRules(writeTemplateRules(t, `
+rules:
+  - template_id: 11111111-1111-4111-8111-111111111111
+    subject: "^\\[FR\\]"
+  - template_id: 22222222-2222-4222-8222-222222222222
+    sender: "*@grafana.cdssandbox.xyz"
+    recipient_domain: cds-snc.ca
+  - template_id: 33333333-3333-4333-8333-333333333333
+    username: jira
+    header_name: X-Jira-Project
+    header_value: "^OPS$"
+  - template_id: 55555555-5555-4555-8555-555555555555
+    header_name: X-Grafana-Alert
+`))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		message    TemplateMessage
+		templateId string
+	}{
+		{
+			name:       "no match uses the default",
+			message:    TemplateMessage{From: "app@example.com", Subject: "Hello", Recipients: []string{"test@test.com"}},
+			templateId: defaultTemplateId,
+		},
+		{
+			name:       "subject",
+			message:    TemplateMessage{Subject: "[FR] Bonjour"},
+			templateId: frenchTemplateId,
+		},
+		{
+			name:       "sender and recipient domain",
+			message:    TemplateMessage{From: "alerts@GRAFANA.cdssandbox.xyz", Recipients: []string{"test@test.com", "ops@cds-snc.ca"}},
+			templateId: grafanaTemplateId,
+		},
+		{
+			name:       "sender without recipient domain",
+			message:    TemplateMessage{From: "alerts@grafana.cdssandbox.xyz", Recipients: []string{"test@test.com"}},
+			templateId: defaultTemplateId,
+		},
+		{
+			name:       "username and header",
+			message:    TemplateMessage{Username: "jira", Header: mail.Header{"X-Jira-Project": []string{"OPS"}}},
+			templateId: jiraTemplateId,
+		},
+		{
+			name:       "header without a value pattern",
+			message:    TemplateMessage{Header: mail.Header{"X-Grafana-Alert": []string{""}}},
+			templateId: alertTemplateId,
+		},
+		{
+			name:       "missing header without a value pattern",
+			message:    TemplateMessage{Header: mail.Header{"X-Jira-Project": []string{"OPS"}}},
+			templateId: defaultTemplateId,
+		},
+		{
+			name:       "explicit header wins",
+			message:    TemplateMessage{Subject: "[FR] Bonjour", Header: mail.Header{"X-Notify-Template-Id": []string{headerTemplateId}}},
+			templateId: headerTemplateId,
+		},
+	}
+
+	for _, test := range tests {
+		templateId, err := selectTemplate(rules, defaultTemplateId, &test.message)
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.templateId, templateId, test.name)
+	}
+
+	_, err = selectTemplate(rules, defaultTemplateId, &TemplateMessage{Header: mail.Header{"X-Notify-Template-Id": []string{"invalid"}}})
+	assert.Equal(t, "X-Notify-Template-Id must be a UUIDv4", err.Error())
+}
+
+func TestMatchAddress(t *testing.T) {
+	assert.True(t, matchAddress("app@example.com", "APP@example.com"))
+	assert.False(t, matchAddress("app@example.com", "other@example.com"))
+	assert.True(t, matchAddress("*@example.com", "anyone@Example.com"))
+	assert.False(t, matchAddress("*@example.com", "anyone@sub.example.com"))
+	assert.False(t, matchAddress("*@example.com", "example.com"))
+}
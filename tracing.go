@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Where spans are exported to, set with Tracing_Exporter
+const (
+	tracingNone = "none"
+	tracingOtlp = "otlp"
+	tracingFile = "file"
+)
+
+const tracerName = "smtp-proxy-for-notify"
+
+func isValidTracingExporter(exporter string) bool {
+	return exporter == tracingNone || exporter == tracingOtlp || exporter == tracingFile
+}
+
+// tracer returns the tracer of the global provider, which doesn't record anything
+// until setupTracing replaces it
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// setupTracing exports spans to the configured exporter and returns the function
+// that flushes them on shutdown
+func setupTracing(config *Config) (func(context.Context) error, error) {
+	// Trace context is passed on to Notify even when spans aren't exported here
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch config.Tracing.Exporter {
+	case tracingOtlp:
+		options := []otlptracehttp.Option{}
+		if config.Tracing.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Tracing.Endpoint))
+		}
+		otlp, err := otlptracehttp.New(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	case tracingFile:
+		file, err := os.OpenFile(config.Tracing.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		exporter = &fileExporter{SpanExporter: stdout, file: file}
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(tracerName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// flushTracesOnExit exports the spans still waiting in the batch when the proxy is
+// stopped, then lets the signal stop it as it would have
+func flushTracesOnExit(shutdown func(context.Context) error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Error().Msgf("Error flushing traces: %s", err)
+	}
+
+	signal.Reset(sig)
+	syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+}
+
+// fileExporter closes the file the spans are written to on shutdown
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	return errors.Join(e.SpanExporter.Shutdown(ctx), e.file.Close())
+}
+
+// endSpan records the error, if there is one, and ends the span. A success reply
+// such as a queued message is not an error.
+func endSpan(span trace.Span, err error) {
+	if !isAccepted(err) {
+		recordError(span, err)
+	}
+	span.End()
+}
+
+// recordError marks the span as failed. Errors such as a DeliveryError list the
+// recipients, so the message is redacted the same way as the logs.
+func recordError(span trace.Span, err error) {
+	message := redactText(err.Error())
+	span.RecordError(errors.New(message))
+	span.SetStatus(codes.Error, message)
+}
+
+// startSessionSpan starts the span of an SMTP connection, which every other span of
+// the session is a child of
+func (s *Session) startSessionSpan() {
+	s.ctx, s.span = tracer().Start(context.Background(), "smtp.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("smtp.session_id", s.Id),
+			semconv.ClientAddress(s.RemoteIp),
+		),
+	)
+}
+
+// context returns the context of the current transaction, or of the session between
+// transactions
+func (s *Session) context() context.Context {
+	if s.transactionCtx != nil {
+		return s.transactionCtx
+	}
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// startTransactionSpan starts the span of a mail transaction, from MAIL FROM until
+// the transaction is reset
+func (s *Session) startTransactionSpan() {
+	s.endTransactionSpan()
+
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.transactionCtx, s.transactionSpan = tracer().Start(ctx, "smtp.transaction",
+		trace.WithAttributes(
+			attribute.Int("smtp.transaction", s.Transaction),
+			attribute.String("smtp.request_id", s.requestId()),
+		),
+	)
+}
+
+func (s *Session) endTransactionSpan() {
+	if s.transactionSpan != nil {
+		if s.Email != nil {
+			s.transactionSpan.SetAttributes(attribute.Int("smtp.recipients", len(s.Email.Emails)))
+		}
+		s.transactionSpan.End()
+	}
+	s.transactionCtx, s.transactionSpan = nil, nil
+}
+
+// failTransaction marks the transaction as failed with the reply sent to the client
+func (s *Session) failTransaction(err error) {
+	if !isAccepted(err) && s.transactionSpan != nil {
+		recordError(s.transactionSpan, err)
+	}
+}
+
+// endSessionSpan ends the spans that are still open when the client disconnects or
+// greets again
+func (s *Session) endSessionSpan() {
+	s.endTransactionSpan()
+	if s.span != nil {
+		s.span.SetAttributes(attribute.String("smtp.username", redactUsername(s.Username)))
+		s.span.End()
+	}
+}
+
+// injectTraceContext returns the trace context as a map that can be saved with a
+// spooled message
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTraceContext reads back a trace context saved with injectTraceContext
+func extractTraceContext(carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(carrier))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracer records every span until the test ends
+func newTestTracer(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+// spansByName returns the ended spans, keyed by name
+func spansByName(recorder *tracetest.SpanRecorder) map[string][]sdktrace.ReadOnlySpan {
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	return spans
+}
+
+func TestSession_Tracing(t *testing.T) {
+	recorder := newTestTracer(t)
+
+	var traceparents []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	session := Session{
+		Client: newNotifyClient("test-api-key", mockServer.URL),
+		Config: &Config{},
+		Email:  &NotifyEmail{},
+		Id:     "0123456789abcdef",
+	}
+	session.Config.Smtp.Username = "test-username"
+	session.Config.Smtp.Password = "test-password-1234"
+	session.Config.Auth.AllowPlaintextPasswords = true
+	session.startSessionSpan()
+
+	assert.NotNil(t, session.AuthPlain("test-username", "wrong-password"))
+	assert.Nil(t, session.AuthPlain("test-username", "test-password-1234"))
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("test@test.com", nil))
+	assert.Nil(t, session.Rcpt("test2@test.com", nil))
+	assert.Nil(t, session.Data(strings.NewReader("To: <test@test.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+	session.Reset()
+	assert.Nil(t, session.Logout())
+
+	spans := spansByName(recorder)
+	assert.Len(t, spans["smtp.session"], 1)
+	assert.Len(t, spans["smtp.auth"], 2)
+	assert.Len(t, spans["smtp.transaction"], 1)
+	assert.Len(t, spans["smtp.data"], 1)
+	assert.Len(t, spans["smtp.parse"], 1)
+	assert.Len(t, spans["notify.post"], 2)
+
+	// Every span is in the session's trace and nested under the span that started it
+	root := spans["smtp.session"][0]
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, root.SpanContext().TraceID(), span.SpanContext().TraceID())
+	}
+	assert.Equal(t, root.SpanContext().SpanID(), spans["smtp.auth"][0].Parent().SpanID())
+	assert.Equal(t, root.SpanContext().SpanID(), spans["smtp.transaction"][0].Parent().SpanID())
+	assert.Equal(t, spans["smtp.transaction"][0].SpanContext().SpanID(), spans["smtp.data"][0].Parent().SpanID())
+	assert.Equal(t, spans["smtp.data"][0].SpanContext().SpanID(), spans["smtp.parse"][0].Parent().SpanID())
+	for _, span := range spans["notify.post"] {
+		assert.Equal(t, spans["smtp.data"][0].SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	// The failed login is marked as an error
+	assert.Equal(t, codes.Error, spans["smtp.auth"][0].Status().Code)
+	assert.Equal(t, codes.Unset, spans["smtp.auth"][1].Status().Code)
+
+	// Notify receives the trace context of its request's span
+	assert.Len(t, traceparents, 2)
+	for _, traceparent := range traceparents {
+		assert.Contains(t, traceparent, root.SpanContext().TraceID().String())
+	}
+}
+
+func TestSession_TracingRejectedTransaction(t *testing.T) {
+	recorder := newTestTracer(t)
+
+	session := Session{
+		Authenticated: true,
+		Config:        &Config{},
+		Email:         &NotifyEmail{},
+		Tenant:        &Tenant{AllowedSenders: []string{"*@example.com"}},
+	}
+	session.startSessionSpan()
+
+	assert.Equal(t, errSenderNotAllowed, session.Mail("noreply@test.com", nil))
+	session.Reset()
+
+	spans := spansByName(recorder)
+	assert.Len(t, spans["smtp.transaction"], 1)
+	assert.Equal(t, codes.Error, spans["smtp.transaction"][0].Status().Code)
+}
+
+func TestSpool_DeliverLinksTrace(t *testing.T) {
+	recorder := newTestTracer(t)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	spool, err := newSpool(t.TempDir(), 0)
+	assert.Nil(t, err)
+
+	ctx, span := tracer().Start(context.Background(), "smtp.data")
+	_, err = spool.Enqueue(&NotifyEmail{Emails: []string{"test@test.com"}, Context: ctx})
+	assert.Nil(t, err)
+	span.End()
+
+	spool.Deliver(newNotifyClient("test-api-key", mockServer.URL))
+
+	spans := spansByName(recorder)
+	assert.Len(t, spans["spool.deliver"], 1)
+	deliver := spans["spool.deliver"][0]
+	assert.Len(t, deliver.Links(), 1)
+	assert.Equal(t, span.SpanContext().TraceID(), deliver.Links()[0].SpanContext.TraceID())
+	assert.Len(t, spans["notify.post"], 1)
+	assert.Equal(t, deliver.SpanContext().SpanID(), spans["notify.post"][0].Parent().SpanID())
+}
+
+func TestSetupTracing_File(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	config := &Config{}
+	config.Tracing.Exporter = tracingFile
+	config.Tracing.File = filepath.Join(t.TempDir(), "traces.json")
+	config.Tracing.SampleRatio = 1
+
+	shutdown, err := setupTracing(config)
+	assert.Nil(t, err)
+
+	_, span := tracer().Start(context.Background(), "smtp.session")
+	span.End()
+	assert.Nil(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(config.Tracing.File)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"Name":"smtp.session"`)
+	assert.Contains(t, string(data), `"Value":"smtp-proxy-for-notify"`)
+}
+
+func TestSetupTracing_None(t *testing.T) {
+	propagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	config := &Config{}
+	config.Tracing.Exporter = tracingNone
+
+	shutdown, err := setupTracing(config)
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.Background()))
+}
+
+func TestSession_TracingRedactsErrors(t *testing.T) {
+	recorder := newTestTracer(t)
+	logRedactor = newRedactor(redactionMask, "")
+	t.Cleanup(func() { logRedactor = nil })
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer mockServer.Close()
+
+	session := Session{
+		Client: newNotifyClient("test-api-key", mockServer.URL),
+		Config: &Config{},
+		Email:  &NotifyEmail{},
+	}
+	session.Config.Smtp.Username = "jane.doe@example.com"
+	session.Config.Smtp.Password = "test-password-1234"
+	session.Config.Auth.AllowPlaintextPasswords = true
+	session.startSessionSpan()
+
+	assert.Nil(t, session.AuthPlain("jane.doe@example.com", "test-password-1234"))
+	assert.Nil(t, session.Mail("noreply@example.com", nil))
+	assert.Nil(t, session.Rcpt("secret.person@example.com", nil))
+	assert.NotNil(t, session.Data(strings.NewReader("To: <secret.person@example.com>\r\nSubject: Test\r\n\r\nTest Body\r\n")))
+	session.Reset()
+	assert.Nil(t, session.Logout())
+
+	spans := spansByName(recorder)
+	assert.Equal(t, codes.Error, spans["smtp.data"][0].Status().Code)
+	assert.Contains(t, spans["smtp.transaction"][0].Status().Description, "s***@example.com")
+
+	// Nothing about the recipient or the user's address reaches the exporter
+	for _, span := range recorder.Ended() {
+		assert.NotContains(t, span.Status().Description, "secret.person")
+		for _, attr := range span.Attributes() {
+			assert.NotContains(t, attr.Value.Emit(), "jane.doe", span.Name())
+		}
+		for _, event := range span.Events() {
+			for _, attr := range event.Attributes {
+				assert.NotContains(t, attr.Value.Emit(), "secret.person", span.Name())
+			}
+		}
+	}
+}
+
+func TestBackend_EndsReplacedSessionSpans(t *testing.T) {
+	recorder := newTestTracer(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := smtp.NewServer(&Backend{Config: &Config{}})
+	server.Domain = "localhost"
+	go server.Serve(listener)
+	defer server.Close()
+
+	// A client that greets twice gets a new session each time
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	for _, command := range []string{"HELO one", "HELO two", "QUIT"} {
+		_, err = conn.Write([]byte(command + "\r\n"))
+		assert.Nil(t, err)
+		_, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+	}
+	conn.Close()
+
+	// and every one of them ends
+	assert.Eventually(t, func() bool {
+		return len(spansByName(recorder)["smtp.session"]) == 2 && len(recorder.Started()) == len(recorder.Ended())
+	}, time.Second, 10*time.Millisecond)
+}
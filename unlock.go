@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// runUnlock asks the running server to clear the lockout of a remote IP or username
+func runUnlock(args []string, out io.Writer) error {
+	viper.AutomaticEnv()
+
+	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	ip := flags.String("ip", "", "remote IP to unlock")
+	username := flags.String("username", "", "username to unlock")
+	addr := flags.String("addr", viper.GetString("Admin_Addr"), "address of the admin server, defaults to ADMIN_ADDR")
+	token := flags.String("token", viper.GetString("Admin_Token"), "admin token, defaults to ADMIN_TOKEN")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *ip == "" && *username == "" {
+		return errors.New("an -ip or -username is required")
+	}
+	if *addr == "" {
+		return errors.New("the admin server address must be set with -addr or ADMIN_ADDR")
+	}
+
+	body, err := json.Marshal(UnlockRequest{Ip: *ip, Username: *username})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, localUrl(*addr)+"/admin/unlock", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var response UnlockResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+
+	if len(response.Unlocked) == 0 {
+		_, err = fmt.Fprintln(out, "Nothing was locked out")
+		return err
+	}
+	for _, entry := range response.Unlocked {
+		if _, err := fmt.Fprintf(out, "Unlocked %s %s\n", entry.Kind, entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localUrl turns a listen address such as :8025 into a URL the server can be reached at
+func localUrl(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunUnlock(t *testing.T) {
+	admin, lockout := newTestAdminServer()
+	server := httptest.NewServer(admin.Handler())
+	defer server.Close()
+
+	lockout.Failure("10.0.0.1", "grafana")
+	lockout.Failure("10.0.0.1", "grafana")
+
+	var out bytes.Buffer
+	err := runUnlock([]string{"-addr", server.URL, "-token", testAdminToken, "-username", "grafana"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "Unlocked username grafana\n", out.String())
+
+	out.Reset()
+	err = runUnlock([]string{"-addr", server.URL, "-token", testAdminToken, "-ip", "10.0.0.1"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "Nothing was locked out\n", out.String())
+
+	err = runUnlock([]string{"-addr", server.URL, "-token", "wrong-token", "-ip", "10.0.0.1"}, &out)
+	assert.Equal(t, "unexpected status code: 401: unauthorized", err.Error())
+
+	err = runUnlock([]string{"-addr", server.URL}, &out)
+	assert.Equal(t, "an -ip or -username is required", err.Error())
+}
+
+func TestLocalUrl(t *testing.T) {
+	assert.Equal(t, "http://localhost:8025", localUrl(":8025"))
+	assert.Equal(t, "http://localhost:8025", localUrl("0.0.0.0:8025"))
+	assert.Equal(t, "http://127.0.0.1:8025", localUrl("127.0.0.1:8025"))
+	assert.Equal(t, "https://admin.example.com", localUrl("https://admin.example.com/"))
+}
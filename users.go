@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tenant is an SMTP user and the Notify service it sends as
+type Tenant struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Notify settings, the hostname defaults to Notify_Hostname
+	ApiKey     string `yaml:"notify_api_key"`
+	Hostname   string `yaml:"notify_hostname"`
+	TemplateId string `yaml:"notify_template_id"`
+
+	Limits TenantLimits `yaml:"limits"`
+
+	// Networks whose clients send as this tenant without authenticating
+	RelayCidrs []string `yaml:"relay_cidrs"`
+
+	// Envelope senders this tenant can use, as addresses or *@domain wildcards.
+	// Any sender is accepted when the list is empty.
+	AllowedSenders []string `yaml:"allowed_senders"`
+
+	// Check the addresses in the From: header against the allowed senders too
+	CheckHeaderFrom bool `yaml:"check_header_from"`
+
+	// Recipients this tenant can send to, on top of the server wide policy
+	Recipients RecipientPolicy `yaml:"recipients"`
+
+	relayNetworks []netip.Prefix
+}
+
+type TenantLimits struct {
+	// Most recipients allowed in a single message, 0 for the server default. The server
+	// refuses more than 10 before the tenant's limit is checked, so it can only lower it.
+	MaxRecipients int `yaml:"max_recipients"`
+
+	// Messages and recipients allowed per minute, 0 for the server default
+	MessagesPerMinute   int `yaml:"messages_per_minute"`
+	RecipientsPerMinute int `yaml:"recipients_per_minute"`
+
+	// Notifications the API key can send per UTC day, 0 for the server default
+	DailyQuota int `yaml:"daily_quota"`
+}
+
+func (l TenantLimits) perMinute(kind string) int {
+	if kind == rateLimitMessages {
+		return l.MessagesPerMinute
+	}
+	return l.RecipientsPerMinute
+}
+
+// loadUsers reads the tenants from a YAML file and validates them
+func loadUsers(path string, defaultHostname string, allowPlaintext bool) ([]*Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Users []*Tenant `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if len(file.Users) == 0 {
+		return nil, errors.New("users file must list at least one user")
+	}
+
+	seen := map[string]bool{}
+	for i, tenant := range file.Users {
+		if tenant.Hostname == "" {
+			tenant.Hostname = defaultHostname
+		}
+
+		if err := validateTenant(tenant, allowPlaintext); err != nil {
+			return nil, fmt.Errorf("user %d: %s", i+1, err)
+		}
+
+		networks, err := parseCidrs(strings.Join(tenant.RelayCidrs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("user %d: relay networks: %s", i+1, err)
+		}
+		tenant.relayNetworks = networks
+
+		if seen[tenant.Username] {
+			return nil, fmt.Errorf("user %d: username %s is listed more than once", i+1, tenant.Username)
+		}
+		seen[tenant.Username] = true
+	}
+
+	return file.Users, nil
+}
+
+func validateTenant(tenant *Tenant, allowPlaintext bool) error {
+	// Validate username is no less than three characters
+	if len(tenant.Username) < 3 {
+		return errors.New("username must be at least three characters")
+	}
+
+	// Validate password is a hash, or a plaintext password of no less than fourteen characters.
+	// A tenant that only relays from trusted networks doesn't need one.
+	if tenant.Password != "" || len(tenant.RelayCidrs) == 0 {
+		if err := validatePassword(tenant.Password, allowPlaintext); err != nil {
+			return err
+		}
+	}
+
+	// Validate API key starts with gcntfy and is not less than 81 characters
+	if len(tenant.ApiKey) < 81 || tenant.ApiKey[:6] != "gcntfy" {
+		return errors.New("API key must start with gcntfy and be at least 81 characters")
+	}
+
+	// Validate Notify Template ID matches a UUIDv4
+	if !isUUIDv4(tenant.TemplateId) {
+		return errors.New("notify Template ID must be a UUIDv4")
+	}
+
+	if tenant.Limits.MaxRecipients < 0 {
+		return errors.New("max recipients must not be negative")
+	}
+
+	if tenant.Limits.MessagesPerMinute < 0 || tenant.Limits.RecipientsPerMinute < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+
+	if tenant.Limits.DailyQuota < 0 {
+		return errors.New("daily quota must not be negative")
+	}
+
+	for _, sender := range tenant.AllowedSenders {
+		if !isValidAddressPattern(sender) {
+			return fmt.Errorf("allowed sender %s must be an address or *@domain", sender)
+		}
+	}
+
+	if err := tenant.Recipients.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// defaultTenant is the single user configured with Smtp_Username and the Notify settings
+func (c *Config) defaultTenant() *Tenant {
+	return &Tenant{
+		Username:   c.Smtp.Username,
+		Password:   c.Smtp.Password,
+		ApiKey:     c.Notify.ApiKey,
+		Hostname:   c.Notify.Hostname,
+		TemplateId: c.Notify.TemplateId,
+
+		AllowedSenders:  c.Auth.AllowedSenders,
+		CheckHeaderFrom: c.Auth.CheckHeaderFrom,
+	}
+}
+
+// isValidAddressPattern reports whether a pattern is an address or a *@domain wildcard
+func isValidAddressPattern(pattern string) bool {
+	if domain, ok := strings.CutPrefix(pattern, "*@"); ok {
+		return domain != "" && !strings.ContainsAny(domain, "*@")
+	}
+	local, domain, ok := strings.Cut(pattern, "@")
+	return ok && local != "" && domain != "" && !strings.ContainsAny(pattern, "*") && !strings.Contains(domain, "@")
+}
+
+// senderAllowed reports whether the tenant can send from the address
+func (t *Tenant) senderAllowed(address string) bool {
+	return len(t.AllowedSenders) == 0 || matchAnyAddress(t.AllowedSenders, address)
+}
+
+// lookupTenant returns the tenant for a username, or nil if there is none
+func (c *Config) lookupTenant(username string) *Tenant {
+	if len(c.Auth.Users) == 0 {
+		if c.Smtp.Username != "" && username == c.Smtp.Username {
+			return c.defaultTenant()
+		}
+		return nil
+	}
+
+	for _, tenant := range c.Auth.Users {
+		if tenant.Username == username {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// relayTenant returns the tenant whose trusted networks most closely match the
+// address, or nil if the client has to authenticate
+func (c *Config) relayTenant(addr netip.Addr) *Tenant {
+	var match *Tenant
+	bits := -1
+	addr = addr.Unmap()
+	for _, tenant := range c.Auth.Users {
+		for _, network := range tenant.relayNetworks {
+			if network.Contains(addr) && network.Bits() > bits {
+				match = tenant
+				bits = network.Bits()
+			}
+		}
+	}
+	return match
+}
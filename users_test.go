@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTenantApiKey = "gcntfy-" + strings.Repeat("a", 74)
+
+func writeUsers(t *testing.T, users string) string {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(strings.ReplaceAll(users, "API_KEY", testTenantApiKey)), 0600))
+	return path
+}
+
+func TestLoadUsers(t *testing.T) {
+	path := writeUsers(t, `
+users:
+  - username: grafana
+    password: grafana-password-1234
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+    limits:
+      max_recipients: 10
+  - username: jira
+    password: jira-password-12345
+    notify_api_key: API_KEY
+    notify_hostname: https://api.notification.alpha.canada.ca
+    notify_template_id: 22222222-2222-4222-8222-222222222222
+`)
+
+	users, err := loadUsers(path, "https://api.notification.canada.ca", true)
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "grafana", users[0].Username)
+	assert.Equal(t, "https://api.notification.canada.ca", users[0].Hostname)
+	assert.Equal(t, 10, users[0].Limits.MaxRecipients)
+	assert.Equal(t, "https://api.notification.alpha.canada.ca", users[1].Hostname)
+	assert.Equal(t, 0, users[1].Limits.MaxRecipients)
+}
+
+func TestLoadUsers_Invalid(t *testing.T) {
+	_, err := loadUsers(writeUsers(t, `users: []`), "", true)
+	assert.Equal(t, "users file must list at least one user", err.Error())
+
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: grafana
+    password: short
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+`), "", true)
+	assert.Equal(t, "user 1: password must be at least fourteen characters", err.Error())
+
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: grafana
+    password: grafana-password-1234
+    notify_api_key: invalid
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+`), "", true)
+	assert.Equal(t, "user 1: API key must start with gcntfy and be at least 81 characters", err.Error())
+
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: grafana
+    password: grafana-password-1234
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+  - username: grafana
+    password: grafana-password-5678
+    notify_api_key: API_KEY
+    notify_template_id: 22222222-2222-4222-8222-222222222222
+`), "", true)
+	assert.Equal(t, "user 2: username grafana is listed more than once", err.Error())
+}
+
+func TestConfig_lookupTenant(t *testing.T) {
+	config := &Config{}
+	config.Smtp.Username = "test-username"
+	config.Smtp.Password = "test-password"
+	config.Notify.TemplateId = "test-template-id"
+
+	// Without a users file the single configured user is the only tenant
+	tenant := config.lookupTenant("test-username")
+	assert.Equal(t, "test-password", tenant.Password)
+	assert.Equal(t, "test-template-id", tenant.TemplateId)
+	assert.Nil(t, config.lookupTenant("grafana"))
+
+	// With a users file the configured user is no longer accepted
+	config.Auth.Users = []*Tenant{{Username: "grafana", Password: "grafana-password-1234"}}
+	assert.Equal(t, "grafana-password-1234", config.lookupTenant("grafana").Password)
+	assert.Nil(t, config.lookupTenant("test-username"))
+}
+
+func TestLoadUsers_RelayCidrs(t *testing.T) {
+	users, err := loadUsers(writeUsers(t, `
+users:
+  - username: scanners
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+    relay_cidrs:
+      - 10.0.0.0/8
+  - username: building
+    notify_api_key: API_KEY
+    notify_template_id: 22222222-2222-4222-8222-222222222222
+    relay_cidrs:
+      - 10.20.0.0/16
+      - 192.168.1.7
+`), "", false)
+	assert.Nil(t, err)
+
+	config := &Config{}
+	config.Auth.Users = users
+
+	// The most specific network wins
+	assert.Equal(t, "scanners", config.relayTenant(netip.MustParseAddr("10.1.2.3")).Username)
+	assert.Equal(t, "building", config.relayTenant(netip.MustParseAddr("10.20.2.3")).Username)
+	assert.Equal(t, "building", config.relayTenant(netip.MustParseAddr("::ffff:192.168.1.7")).Username)
+	assert.Nil(t, config.relayTenant(netip.MustParseAddr("192.168.1.8")))
+
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: scanners
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+    relay_cidrs:
+      - office
+`), "", false)
+	assert.Equal(t, "user 1: relay networks: invalid CIDR office", err.Error())
+
+	// Without relay networks the password is required
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: scanners
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+`), "", false)
+	assert.Equal(t, "user 1: "+errPlaintextPassword.Error(), err.Error())
+}
+
+func TestTenant_senderAllowed(t *testing.T) {
+	// Any sender is allowed without a list
+	assert.True(t, (&Tenant{}).senderAllowed("anyone@example.com"))
+
+	tenant := &Tenant{AllowedSenders: []string{"alerts@example.com", "*@grafana.example.com"}}
+	assert.True(t, tenant.senderAllowed("Alerts@Example.com"))
+	assert.True(t, tenant.senderAllowed("noreply@grafana.example.com"))
+	assert.False(t, tenant.senderAllowed("ceo@example.com"))
+	assert.False(t, tenant.senderAllowed("noreply@evil.grafana.example.com"))
+	assert.False(t, tenant.senderAllowed(""))
+}
+
+func Test_isValidAddressPattern(t *testing.T) {
+	assert.True(t, isValidAddressPattern("alerts@example.com"))
+	assert.True(t, isValidAddressPattern("*@example.com"))
+	assert.False(t, isValidAddressPattern("example.com"))
+	assert.False(t, isValidAddressPattern("*@"))
+	assert.False(t, isValidAddressPattern("*@*.example.com"))
+	assert.False(t, isValidAddressPattern("alerts*@example.com"))
+	assert.False(t, isValidAddressPattern("@example.com"))
+}
+
+func TestLoadUsers_Recipients(t *testing.T) {
+	users, err := loadUsers(writeUsers(t, `
+users:
+  - username: staging
+    password: staging-password-1234
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+    recipients:
+      allow:
+        - "*@cds-snc.ca"
+      deny:
+        - ceo@cds-snc.ca
+`), "", true)
+	assert.Nil(t, err)
+	assert.Equal(t, RecipientPolicy{Allow: []string{"*@cds-snc.ca"}, Deny: []string{"ceo@cds-snc.ca"}}, users[0].Recipients)
+
+	_, err = loadUsers(writeUsers(t, `
+users:
+  - username: staging
+    password: staging-password-1234
+    notify_api_key: API_KEY
+    notify_template_id: 11111111-1111-4111-8111-111111111111
+    recipients:
+      allow:
+        - cds-snc.ca
+`), "", true)
+	assert.Equal(t, "user 1: recipient allow list: cds-snc.ca must be an address or *@domain", err.Error())
+}